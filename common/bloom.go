@@ -0,0 +1,90 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// maxHashBloomProbes is the number of independent 32 bit bit-indexes that can be
+// cut out of a single hash.
+const maxHashBloomProbes = HashLength / 4
+
+// HashBloom is a space efficient, probabilistic set of hashes. It never reports
+// an added hash as missing, but may report a never added hash as present with a
+// probability depending on the number of items and the size of the filter. As
+// hashes are already uniformly distributed, their bytes are used directly as the
+// bit indexes instead of rehashing them.
+//
+// HashBloom is not safe for concurrent use.
+type HashBloom struct {
+	bits   []uint64
+	probes int
+}
+
+// NewHashBloom creates a bloom filter sized to hold the given number of hashes
+// while keeping the false positive rate around the requested probability.
+func NewHashBloom(items int, rate float64) *HashBloom {
+	if items < 1 {
+		items = 1
+	}
+	bits := math.Ceil(-float64(items) * math.Log(rate) / (math.Ln2 * math.Ln2))
+	probes := int(math.Ceil(bits / float64(items) * math.Ln2))
+	if probes < 1 {
+		probes = 1
+	}
+	if probes > maxHashBloomProbes {
+		probes = maxHashBloomProbes
+	}
+	return &HashBloom{
+		bits:   make([]uint64, (int(bits)+63)/64),
+		probes: probes,
+	}
+}
+
+// Add inserts a hash into the bloom filter.
+func (self *HashBloom) Add(hash Hash) {
+	for i := 0; i < self.probes; i++ {
+		bit := self.bit(hash, i)
+		self.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain checks whether a hash might have been added to the bloom filter.
+// A false result is definitive, a true one may be a false positive.
+func (self *HashBloom) MayContain(hash Hash) bool {
+	for i := 0; i < self.probes; i++ {
+		bit := self.bit(hash, i)
+		if self.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Reset clears all the hashes from the bloom filter.
+func (self *HashBloom) Reset() {
+	for i := range self.bits {
+		self.bits[i] = 0
+	}
+}
+
+// bit calculates the index of the bit to set or check for a specific probe.
+func (self *HashBloom) bit(hash Hash, probe int) uint64 {
+	return uint64(binary.BigEndian.Uint32(hash[probe*4:])) % uint64(len(self.bits)*64)
+}
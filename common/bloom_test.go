@@ -0,0 +1,69 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestHashBloom(t *testing.T) {
+	const (
+		items = 10000
+		rate  = 0.01
+	)
+	rnd := rand.New(rand.NewSource(1))
+	random := func() (hash Hash) {
+		rnd.Read(hash[:])
+		return
+	}
+	bloom := NewHashBloom(items, rate)
+
+	// Insert a batch of hashes and ensure none of them go missing
+	added := make(map[Hash]struct{}, items)
+	for i := 0; i < items; i++ {
+		hash := random()
+		added[hash] = struct{}{}
+		bloom.Add(hash)
+	}
+	for hash := range added {
+		if !bloom.MayContain(hash) {
+			t.Fatalf("false negative for added hash %x", hash)
+		}
+	}
+	// Probe the filter with never added hashes and check the false positive rate
+	positives, probes := 0, 10*items
+	for i := 0; i < probes; i++ {
+		hash := random()
+		if _, ok := added[hash]; ok {
+			continue
+		}
+		if bloom.MayContain(hash) {
+			positives++
+		}
+	}
+	if have := float64(positives) / float64(probes); have > 2*rate {
+		t.Fatalf("false positive rate too high: have %v, want at most %v", have, 2*rate)
+	}
+	// Reset the filter and ensure it's empty
+	bloom.Reset()
+	for hash := range added {
+		if bloom.MayContain(hash) {
+			t.Fatalf("hash %x present after reset", hash)
+		}
+	}
+}
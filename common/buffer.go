@@ -0,0 +1,136 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OverflowPolicy defines how a BoundedBuffer handles insertions when full.
+type OverflowPolicy int
+
+const (
+	DropOldest OverflowPolicy = iota // Evict the oldest buffered item to make room
+	DropNewest                       // Discard the item being inserted
+	Block                            // Wait until an item is popped
+)
+
+// String implements fmt.Stringer.
+func (self OverflowPolicy) String() string {
+	switch self {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(self))
+	}
+}
+
+// BoundedBuffer is a fixed capacity FIFO ring buffer, handling overflows as
+// dictated by its policy and counting the items dropped because of them.
+//
+// BoundedBuffer is safe for concurrent use.
+type BoundedBuffer struct {
+	items   []interface{} // Ring of buffered items
+	head    int           // Index of the oldest buffered item
+	size    int           // Number of buffered items
+	policy  OverflowPolicy
+	dropped uint64 // Number of items dropped due to overflows
+
+	lock   sync.Mutex
+	popped *sync.Cond // Signalled when room frees up, waking blocked pushes
+}
+
+// NewBoundedBuffer creates an empty buffer holding at most capacity items.
+func NewBoundedBuffer(capacity int, policy OverflowPolicy) *BoundedBuffer {
+	if capacity < 1 {
+		panic("bounded buffer capacity must be positive")
+	}
+	buffer := &BoundedBuffer{
+		items:  make([]interface{}, capacity),
+		policy: policy,
+	}
+	buffer.popped = sync.NewCond(&buffer.lock)
+	return buffer
+}
+
+// Push appends an item to the buffer, applying the overflow policy if it is
+// full. It reports whether the item was inserted, which it always is unless the
+// policy is DropNewest.
+func (self *BoundedBuffer) Push(item interface{}) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.size == len(self.items) {
+		switch self.policy {
+		case DropNewest:
+			self.dropped++
+			return false
+
+		case Block:
+			for self.size == len(self.items) {
+				self.popped.Wait()
+			}
+		default:
+			self.items[self.head] = nil
+			self.head = (self.head + 1) % len(self.items)
+			self.size--
+			self.dropped++
+		}
+	}
+	self.items[(self.head+self.size)%len(self.items)] = item
+	self.size++
+	return true
+}
+
+// Pop removes and returns the oldest item from the buffer, reporting false if
+// the buffer is empty.
+func (self *BoundedBuffer) Pop() (interface{}, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.size == 0 {
+		return nil, false
+	}
+	item := self.items[self.head]
+	self.items[self.head] = nil
+	self.head = (self.head + 1) % len(self.items)
+	self.size--
+
+	self.popped.Signal()
+	return item, true
+}
+
+// Len returns the number of buffered items.
+func (self *BoundedBuffer) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.size
+}
+
+// Dropped returns the number of items dropped due to overflows so far.
+func (self *BoundedBuffer) Dropped() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.dropped
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// drainBuffer pops all the items from a buffer.
+func drainBuffer(buffer *BoundedBuffer) []interface{} {
+	var items []interface{}
+	for {
+		item, ok := buffer.Pop()
+		if !ok {
+			return items
+		}
+		items = append(items, item)
+	}
+}
+
+func TestBoundedBufferDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy OverflowPolicy
+		items  []interface{}
+	}{
+		{DropOldest, []interface{}{2, 3, 4}},
+		{DropNewest, []interface{}{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		buffer := NewBoundedBuffer(3, tt.policy)
+		for i := 0; i < 5; i++ {
+			if inserted := buffer.Push(i); inserted != (i < 3 || tt.policy == DropOldest) {
+				t.Errorf("%v: item %d: insertion mismatch: have %v", tt.policy, i, inserted)
+			}
+		}
+		if dropped := buffer.Dropped(); dropped != 2 {
+			t.Errorf("%v: dropped count mismatch: have %d, want %d", tt.policy, dropped, 2)
+		}
+		items := drainBuffer(buffer)
+		if len(items) != len(tt.items) {
+			t.Fatalf("%v: buffered items mismatch: have %v, want %v", tt.policy, items, tt.items)
+		}
+		for i := range items {
+			if items[i] != tt.items[i] {
+				t.Fatalf("%v: buffered items mismatch: have %v, want %v", tt.policy, items, tt.items)
+			}
+		}
+	}
+}
+
+func TestBoundedBufferBlock(t *testing.T) {
+	buffer := NewBoundedBuffer(2, Block)
+	buffer.Push(0)
+	buffer.Push(1)
+
+	// Push into the full buffer and ensure it blocks until an item is popped
+	done := make(chan struct{})
+	go func() {
+		buffer.Push(2)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("push into full buffer did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if item, _ := buffer.Pop(); item != 0 {
+		t.Fatalf("popped item mismatch: have %v, want %v", item, 0)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("blocked push not released by pop")
+	}
+	if items := drainBuffer(buffer); len(items) != 2 || items[0] != 1 || items[1] != 2 {
+		t.Fatalf("buffered items mismatch: have %v, want [1 2]", items)
+	}
+	if dropped := buffer.Dropped(); dropped != 0 {
+		t.Fatalf("dropped count mismatch: have %d, want %d", dropped, 0)
+	}
+}
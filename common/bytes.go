@@ -41,6 +41,15 @@ func FromHex(s string) []byte {
 	return nil
 }
 
+// ParseHex decodes a hex string with an optional 0x prefix. Unlike FromHex, it
+// reports malformed input as an error instead of silently discarding it.
+func ParseHex(s string) ([]byte, error) {
+	if len(s) > 1 && (s[0:2] == "0x" || s[0:2] == "0X") {
+		s = s[2:]
+	}
+	return hex.DecodeString(s)
+}
+
 // Copy bytes
 //
 // Returns an exact copy of the provided bytes
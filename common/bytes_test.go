@@ -86,3 +86,29 @@ func TestFromHexOddLength(t *testing.T) {
 		t.Errorf("Expected % x got % x", expected, result)
 	}
 }
+
+func TestParseHex(t *testing.T) {
+	tests := []struct {
+		input  string
+		output []byte
+		fail   bool
+	}{
+		{input: "", output: []byte{}},
+		{input: "0x", output: []byte{}},
+		{input: "0x01ff", output: []byte{0x01, 0xff}},
+		{input: "0X01FF", output: []byte{0x01, 0xff}},
+		{input: "01ff", output: []byte{0x01, 0xff}},
+		{input: "0x1ff", fail: true},
+		{input: "0x01fg", fail: true},
+	}
+	for i, tt := range tests {
+		output, err := ParseHex(tt.input)
+		if (err != nil) != tt.fail {
+			t.Errorf("test %d: failure mismatch: have %v, want failure %v", i, err, tt.fail)
+			continue
+		}
+		if err == nil && !bytes.Equal(output, tt.output) {
+			t.Errorf("test %d: output mismatch: have %x, want %x", i, output, tt.output)
+		}
+	}
+}
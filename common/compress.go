@@ -0,0 +1,133 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// Compression is the tag of a compression algorithm. The values are meant to be
+// persisted and sent over the wire, so they must never be reassigned.
+type Compression byte
+
+const (
+	CompressionNone    Compression = 0 // Data is stored as is
+	CompressionSnappy  Compression = 1 // Snappy block format, fast with moderate ratio
+	CompressionDeflate Compression = 2 // Raw deflate stream, slower with better ratio
+)
+
+// ErrDecompressLimit is returned if decompressed data would exceed the size limit
+// requested by the caller.
+var ErrDecompressLimit = errors.New("decompressed data too large")
+
+// String implements fmt.Stringer, returning the name of the algorithm.
+func (self Compression) String() string {
+	switch self {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(self))
+	}
+}
+
+// Compress compresses a blob of data with the requested algorithm.
+func Compress(algo Compression, data []byte) ([]byte, error) {
+	switch algo {
+	case CompressionNone:
+		return CopyBytes(data), nil
+
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+
+	case CompressionDeflate:
+		buffer := new(bytes.Buffer)
+		writer, err := flate.NewWriter(buffer, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm: %v", algo)
+	}
+}
+
+// Decompress restores a blob of data compressed with the specified algorithm,
+// refusing to produce more than maxSize bytes. As compressed data may expand by
+// orders of magnitude, untrusted input must always be bounded this way.
+func Decompress(algo Compression, data []byte, maxSize int) ([]byte, error) {
+	switch algo {
+	case CompressionNone:
+		if len(data) > maxSize {
+			return nil, decompressLimitError(len(data), maxSize, false)
+		}
+		return CopyBytes(data), nil
+
+	case CompressionSnappy:
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxSize {
+			return nil, decompressLimitError(size, maxSize, false)
+		}
+		return snappy.Decode(nil, data)
+
+	case CompressionDeflate:
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+
+		// Read one byte past the limit to detect oversized streams
+		blob, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(blob) > maxSize {
+			return nil, decompressLimitError(len(blob), maxSize, true)
+		}
+		return blob, nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm: %v", algo)
+	}
+}
+
+// decompressLimitError creates the error of a decompression exceeding the limit.
+// Streams cut short past the limit only know a lower bound of their size.
+func decompressLimitError(size, maxSize int, bound bool) error {
+	if bound {
+		return fmt.Errorf("%v: have at least %d bytes, want at most %d", ErrDecompressLimit, size, maxSize)
+	}
+	return fmt.Errorf("%v: have %d bytes, want at most %d", ErrDecompressLimit, size, maxSize)
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		bytes.Repeat([]byte("compressible "), 1024),
+	}
+	for _, algo := range []Compression{CompressionNone, CompressionSnappy, CompressionDeflate} {
+		for i, input := range inputs {
+			compressed, err := Compress(algo, input)
+			if err != nil {
+				t.Fatalf("%v, input %d: failed to compress: %v", algo, i, err)
+			}
+			output, err := Decompress(algo, compressed, len(input))
+			if err != nil {
+				t.Fatalf("%v, input %d: failed to decompress: %v", algo, i, err)
+			}
+			if !bytes.Equal(output, input) {
+				t.Errorf("%v, input %d: round trip mismatch: have %x, want %x", algo, i, output, input)
+			}
+		}
+	}
+}
+
+func TestCompressUnknown(t *testing.T) {
+	if _, err := Compress(Compression(0xff), []byte("data")); err == nil {
+		t.Errorf("unknown algorithm compression succeeded")
+	}
+	if _, err := Decompress(Compression(0xff), []byte("data"), 4); err == nil {
+		t.Errorf("unknown algorithm decompression succeeded")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// A megabyte of zeroes compresses into a tiny blob
+	bomb := make([]byte, 1024*1024)
+	for _, algo := range []Compression{CompressionNone, CompressionSnappy, CompressionDeflate} {
+		compressed, err := Compress(algo, bomb)
+		if err != nil {
+			t.Fatalf("%v: failed to compress: %v", algo, err)
+		}
+		limit := fmt.Sprintf("bytes, want at most %d", len(bomb)-1)
+		if _, err := Decompress(algo, compressed, len(bomb)-1); err == nil || !strings.HasPrefix(err.Error(), ErrDecompressLimit.Error()+": have ") || !strings.HasSuffix(err.Error(), limit) {
+			t.Errorf("%v: oversized decompression error mismatch: have %v, want %v", algo, err, ErrDecompressLimit)
+		}
+		if output, err := Decompress(algo, compressed, len(bomb)); err != nil || len(output) != len(bomb) {
+			t.Errorf("%v: decompression at the limit failed: have %d bytes, err %v", algo, len(output), err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import "sort"
+
+// MergeConfig layers environment configuration values on top of those loaded
+// from a file, the former taking precedence. Besides the merged values, it also
+// returns the sorted list of file keys whose values the environment overrode, so
+// callers can log them. Neither input is modified.
+func MergeConfig(fileCfg, envCfg map[string]string) (map[string]string, []string) {
+	merged := make(map[string]string, len(fileCfg)+len(envCfg))
+	for key, value := range fileCfg {
+		merged[key] = value
+	}
+	var overridden []string
+	for key, value := range envCfg {
+		if old, ok := merged[key]; ok && old != value {
+			overridden = append(overridden, key)
+		}
+		merged[key] = value
+	}
+	sort.Strings(overridden)
+	return merged, overridden
+}
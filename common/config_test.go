@@ -0,0 +1,40 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeConfig(t *testing.T) {
+	file := map[string]string{"ttl": "50", "pow": "2", "store": "memory"}
+	env := map[string]string{"pow": "4", "store": "memory", "salt": "secret"}
+
+	merged, overridden := MergeConfig(file, env)
+
+	want := map[string]string{"ttl": "50", "pow": "4", "store": "memory", "salt": "secret"}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged config mismatch: have %v, want %v", merged, want)
+	}
+	if want := []string{"pow"}; !reflect.DeepEqual(overridden, want) {
+		t.Errorf("overridden keys mismatch: have %v, want %v", overridden, want)
+	}
+	if file["pow"] != "2" {
+		t.Errorf("file config modified: have %q, want %q", file["pow"], "2")
+	}
+}
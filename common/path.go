@@ -17,6 +17,8 @@
 package common
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -38,3 +40,26 @@ func HomeDir() string {
 	}
 	return ""
 }
+
+// CheckWritable verifies that files can be created in the given directory by
+// writing and removing a temporary file, surfacing permission or disk space
+// problems before a node starts relying on the directory.
+func CheckWritable(dir string) error {
+	file, err := ioutil.TempFile(dir, ".writecheck")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %v", dir, err)
+	}
+	name := file.Name()
+
+	_, err = file.Write([]byte{0})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writable")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := CheckWritable(dir); err != nil {
+		t.Fatalf("writable directory rejected: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("leftover files in checked directory: %d", len(files))
+	}
+	if err := CheckWritable(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("missing directory accepted")
+	}
+}
+
+func TestCheckWritableReadOnly(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks are bypassed when running as root")
+	}
+	dir, err := ioutil.TempDir("", "readonly")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Chmod(dir, 0700)
+
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatalf("failed to make directory read-only: %v", err)
+	}
+	if err := CheckWritable(dir); err == nil {
+		t.Fatalf("read-only directory accepted")
+	}
+}
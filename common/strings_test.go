@@ -0,0 +1,75 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import "testing"
+
+var camelCaseTests = []struct {
+	input  string
+	output string
+}{
+	{"", ""},
+	{"ttl", "ttl"},
+	{"max_message_size", "maxMessageSize"},
+	{"max-message-size", "maxMessageSize"},
+	{"max message size", "maxMessageSize"},
+	{"MAX_MESSAGE_SIZE", "maxMessageSize"},
+	{"Min_PoW", "minPoW"},
+	{"maxMessageSize", "maxMessageSize"},
+	{"__leading--and__trailing__", "leadingAndTrailing"},
+}
+
+func TestToCamelCase(t *testing.T) {
+	for i, tt := range camelCaseTests {
+		if output := ToCamelCase(tt.input); output != tt.output {
+			t.Errorf("test %d: camel case mismatch for %q: have %q, want %q", i, tt.input, output, tt.output)
+		}
+	}
+}
+
+var parseBoolTests = []struct {
+	input  string
+	output bool
+	fail   bool
+}{
+	{input: "true", output: true},
+	{input: "TRUE", output: true},
+	{input: "1", output: true},
+	{input: "yes", output: true},
+	{input: " On ", output: true},
+	{input: "false", output: false},
+	{input: "False", output: false},
+	{input: "0", output: false},
+	{input: "NO", output: false},
+	{input: "off", output: false},
+	{input: "", fail: true},
+	{input: "maybe", fail: true},
+	{input: "2", fail: true},
+}
+
+func TestParseBool(t *testing.T) {
+	for i, tt := range parseBoolTests {
+		output, err := ParseBool(tt.input)
+		if (err != nil) != tt.fail {
+			t.Errorf("test %d: failure mismatch for %q: have %v, want failure %v", i, tt.input, err, tt.fail)
+			continue
+		}
+		if output != tt.output {
+			t.Errorf("test %d: value mismatch for %q: have %v, want %v", i, tt.input, output, tt.output)
+		}
+	}
+}
@@ -17,7 +17,10 @@
 // Package filter implements event filters.
 package filter
 
-import "reflect"
+import (
+	"reflect"
+	"sync"
+)
 
 type Filter interface {
 	Compare(Filter) bool
@@ -32,6 +35,7 @@ type FilterEvent struct {
 type Filters struct {
 	id       int
 	watchers map[int]Filter
+	lock     sync.RWMutex
 	ch       chan FilterEvent
 
 	quit chan struct{}
@@ -58,6 +62,9 @@ func (self *Filters) Notify(filter Filter, data interface{}) {
 }
 
 func (self *Filters) Install(watcher Filter) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	self.watchers[self.id] = watcher
 	self.id++
 
@@ -65,9 +72,26 @@ func (self *Filters) Install(watcher Filter) int {
 }
 
 func (self *Filters) Uninstall(id int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	delete(self.watchers, id)
 }
 
+// Replace atomically swaps the watcher installed under an id, reporting whether
+// there was one to replace. Each event is matched either against the old or the
+// new watcher, never neither.
+func (self *Filters) Replace(id int, watcher Filter) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, ok := self.watchers[id]; !ok {
+		return false
+	}
+	self.watchers[id] = watcher
+	return true
+}
+
 func (self *Filters) loop() {
 out:
 	for {
@@ -75,13 +99,23 @@ out:
 		case <-self.quit:
 			break out
 		case event := <-self.ch:
+			// Collect the matching watchers, but trigger them outside of the
+			// lock to allow handlers to install and uninstall filters
+			var matches []Filter
+
+			self.lock.RLock()
 			for _, watcher := range self.watchers {
 				if reflect.TypeOf(watcher) == reflect.TypeOf(event.filter) {
 					if watcher.Compare(event.filter) {
-						watcher.Trigger(event.data)
+						matches = append(matches, watcher)
 					}
 				}
 			}
+			self.lock.RUnlock()
+
+			for _, watcher := range matches {
+				watcher.Trigger(event.data)
+			}
 		}
 	}
 }
@@ -91,5 +125,8 @@ func (self *Filters) Match(a, b Filter) bool {
 }
 
 func (self *Filters) Get(i int) Filter {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
 	return self.watchers[i]
 }
@@ -93,7 +93,7 @@ func (s *PublicWhisperAPI) NewFilter(args NewFilterArgs) (*rpc.HexNumber, error)
 	filter := Filter{
 		To:     crypto.ToECDSAPub(common.FromHex(args.To)),
 		From:   crypto.ToECDSAPub(common.FromHex(args.From)),
-		Topics: NewFilterTopics(args.Topics...),
+		Topics: s.w.NewFilterTopics(args.Topics...),
 		Fn: func(message *Message) {
 			wmsg := NewWhisperMessage(message)
 			s.messagesMu.RLock() // Only read lock to the filter pool
@@ -104,7 +104,10 @@ func (s *PublicWhisperAPI) NewFilter(args NewFilterArgs) (*rpc.HexNumber, error)
 		},
 	}
 
-	id = s.w.Watch(filter)
+	id, err := s.w.Subscribe(filter)
+	if err != nil {
+		return nil, err
+	}
 
 	s.messagesMu.Lock()
 	s.messages[id] = newWhisperFilter(id, s.w)
@@ -133,6 +136,7 @@ func (s *PublicWhisperAPI) UninstallFilter(filterId rpc.HexNumber) bool {
 
 	if _, ok := s.messages[filterId.Int()]; ok {
 		delete(s.messages, filterId.Int())
+		s.w.Unwatch(filterId.Int())
 		return true
 	}
 	return false
@@ -181,7 +185,7 @@ func (s *PublicWhisperAPI) Post(args PostArgs) (bool, error) {
 	options := Options{
 		To:     crypto.ToECDSAPub(common.FromHex(args.To)),
 		TTL:    time.Duration(args.TTL) * time.Second,
-		Topics: NewTopics(args.Topics...),
+		Topics: s.w.NewTopics(args.Topics...),
 	}
 
 	// set sender identity
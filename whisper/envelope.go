@@ -76,6 +76,35 @@ func (self *Envelope) Seal(pow time.Duration) {
 	}
 }
 
+// PoW calculates the proof of work the envelope was sealed with, measured as the
+// number of trailing zero bits of the sealing hash.
+func (self *Envelope) PoW() float64 {
+	d := make([]byte, 64)
+	copy(d[:32], self.rlpWithoutNonce())
+	binary.BigEndian.PutUint32(d[60:], self.Nonce)
+
+	return float64(common.FirstBitSet(new(big.Int).SetBytes(crypto.Keccak256(d))))
+}
+
+// envelopeTopicCount walks the raw RLP encoding of an envelope and counts the
+// topics in it, without decoding any of them.
+func envelopeTopicCount(data []byte) (int, error) {
+	fields, _, err := rlp.SplitList(data)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < 2; i++ { // Skip the expiry and TTL
+		if _, _, fields, err = rlp.Split(fields); err != nil {
+			return 0, err
+		}
+	}
+	topics, _, err := rlp.SplitList(fields)
+	if err != nil {
+		return 0, err
+	}
+	return rlp.CountValues(topics)
+}
+
 // rlpWithoutNonce returns the RLP encoded envelope contents, except the nonce.
 func (self *Envelope) rlpWithoutNonce() []byte {
 	enc, _ := rlp.EncodeToBytes([]interface{}{self.Expiry, self.TTL, self.Topics, self.Data})
@@ -86,12 +115,18 @@ func (self *Envelope) rlpWithoutNonce() []byte {
 func (self *Envelope) Open(key *ecdsa.PrivateKey) (msg *Message, err error) {
 	// Split open the payload into a message construct
 	data := self.Data
+	if len(data) == 0 {
+		return nil, fmt.Errorf("unable to open envelope. Empty payload, flags missing")
+	}
 
 	message := &Message{
-		Flags: data[0],
-		Sent:  time.Unix(int64(self.Expiry-self.TTL), 0),
-		TTL:   time.Duration(self.TTL) * time.Second,
-		Hash:  self.Hash(),
+		Flags:  data[0],
+		Sent:   time.Unix(int64(self.Expiry-self.TTL), 0),
+		TTL:    time.Duration(self.TTL) * time.Second,
+		PoW:    self.PoW(),
+		Topics: self.Topics,
+		Hash:   self.Hash(),
+		expiry: newMessageExpiry(realClock),
 	}
 	data = data[1:]
 
@@ -105,14 +140,17 @@ func (self *Envelope) Open(key *ecdsa.PrivateKey) (msg *Message, err error) {
 
 	// Decrypt the message, if requested
 	if key == nil {
+		message.unfold()
 		return message, nil
 	}
 	err = message.decrypt(key)
 	switch err {
 	case nil:
+		message.unfold()
 		return message, nil
 
 	case ecies.ErrInvalidPublicKey: // Payload isn't encrypted
+		message.unfold()
 		return message, err
 
 	default:
@@ -129,6 +167,47 @@ func (self *Envelope) Hash() common.Hash {
 	return self.hash
 }
 
+// DecodeEnvelope parses a single RLP encoded envelope from an untrusted binary
+// blob, verifying that it holds at least the message flags needed to open it.
+//
+// The decoder never panics on arbitrary input and its allocations are bounded by
+// the size of the input, making it a safe entry point for fuzzing.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	// Count the topics without decoding them to avoid allocating for bogus lists
+	if topics, err := envelopeTopicCount(data); err != nil {
+		return nil, err
+	} else if topics > maxEnvelopeTopics {
+		return nil, fmt.Errorf("invalid envelope: too many topics: have %d, want at most %d", topics, maxEnvelopeTopics)
+	}
+	envelope := new(Envelope)
+	if err := rlp.DecodeBytes(data, envelope); err != nil {
+		return nil, err
+	}
+	if err := envelope.validate(); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// validate checks the well formedness of an envelope received from an untrusted
+// source, be it a decoded blob or a remote peer: it must hold at least the
+// message flags needed to open it, and it may carry at most maxEnvelopeTopics
+// topics, none of them wild-cards.
+func (self *Envelope) validate() error {
+	if len(self.Topics) > maxEnvelopeTopics {
+		return fmt.Errorf("invalid envelope: too many topics: have %d, want at most %d", len(self.Topics), maxEnvelopeTopics)
+	}
+	if len(self.Data) == 0 {
+		return fmt.Errorf("invalid envelope: empty payload")
+	}
+	for i, topic := range self.Topics {
+		if topic.IsWildcard() {
+			return fmt.Errorf("invalid envelope: topic %d: %v", i, ErrWildcardTopic)
+		}
+	}
+	return nil
+}
+
 // DecodeRLP decodes an Envelope from an RLP data stream.
 func (self *Envelope) DecodeRLP(s *rlp.Stream) error {
 	raw, err := s.Raw()
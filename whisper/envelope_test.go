@@ -23,6 +23,7 @@ import (
 
 	"github.com/aiblocksproject/go-aiblocks/crypto"
 	"github.com/aiblocksproject/go-aiblocks/crypto/ecies"
+	"github.com/aiblocksproject/go-aiblocks/rlp"
 )
 
 func TestEnvelopeOpen(t *testing.T) {
@@ -156,3 +157,94 @@ func TestEnvelopeIdentifiedOpenTargeted(t *testing.T) {
 		t.Fatalf("payload mismatch: have 0x%x, want 0x%x", opened.Payload, payload)
 	}
 }
+
+// Tests that envelopes crafted to crash the opening logic are rejected.
+func TestEnvelopeDecodeRegressions(t *testing.T) {
+	tests := []struct {
+		envelope []interface{}
+		decodes  bool
+	}{
+		// Empty payload, used to panic on flag extraction
+		{envelope: []interface{}{uint32(0), uint32(0), []Topic{}, []byte{}, uint32(0)}, decodes: false},
+		// Signature flag set, but not enough data for one
+		{envelope: []interface{}{uint32(0), uint32(0), []Topic{}, []byte{signatureFlag, 0x01}, uint32(0)}, decodes: true},
+		// Expiry before the TTL, used to underflow the send time
+		{envelope: []interface{}{uint32(1), uint32(2), []Topic{}, []byte{0x00}, uint32(0)}, decodes: true},
+	}
+	for i, tt := range tests {
+		blob, err := rlp.EncodeToBytes(tt.envelope)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode envelope: %v", i, err)
+		}
+		envelope, err := DecodeEnvelope(blob)
+		if (err == nil) != tt.decodes {
+			t.Errorf("test %d: decode result mismatch: have %v, want success %v", i, err, tt.decodes)
+			continue
+		}
+		if envelope != nil {
+			envelope.Open(nil)
+		}
+		// Make sure opening a forcefully constructed envelope doesn't crash either
+		raw := &Envelope{Data: tt.envelope[3].([]byte)}
+		raw.Open(nil)
+	}
+}
+
+func TestEnvelopeDecodeTopicLimit(t *testing.T) {
+	// Envelopes within the topic limit decode fine, beyond it they're rejected
+	for _, count := range []int{maxEnvelopeTopics, maxEnvelopeTopics + 1} {
+		topics := make([]Topic, count)
+		for i := range topics {
+			topics[i] = Topic{0xff, byte(i >> 16), byte(i >> 8), byte(i)}
+		}
+		blob, _ := rlp.EncodeToBytes(&Envelope{Topics: topics, Data: []byte{0}})
+		_, err := DecodeEnvelope(blob)
+		if count <= maxEnvelopeTopics && err != nil {
+			t.Errorf("%d topics: failed to decode: %v", count, err)
+		}
+		if count > maxEnvelopeTopics && err == nil {
+			t.Errorf("%d topics: decoded beyond the limit", count)
+		}
+	}
+	// Envelopes declaring a huge topic list must fail without allocating for it
+	huge := []byte{
+		0xf9, 0xff, 0xff, // envelope list, 64KB declared
+		0x01, 0x01, // expiry and TTL
+		0xfb, 0xff, 0xff, 0xff, 0xff, // topic list, 4GB declared
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := DecodeEnvelope(huge); err == nil {
+			t.Fatalf("huge topic list decoded")
+		}
+	})
+	if allocs > 10 {
+		t.Errorf("huge topic list allocations: have %v, want at most %v", allocs, 10)
+	}
+}
+
+func FuzzDecodeEnvelope(f *testing.F) {
+	envelope, err := NewMessage([]byte("fuzz seed")).Wrap(0, Options{Topics: newTopicsFromStrings("a", "b")})
+	if err != nil {
+		f.Fatalf("failed to wrap seed message: %v", err)
+	}
+	seed, err := rlp.EncodeToBytes(envelope)
+	if err != nil {
+		f.Fatalf("failed to encode seed envelope: %v", err)
+	}
+	f.Add(seed)
+	f.Add([]byte{})
+	f.Add([]byte{0xc0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		envelope, err := DecodeEnvelope(data)
+		if err != nil {
+			return
+		}
+		if _, err := envelope.Open(nil); err != nil {
+			return
+		}
+		if _, err := rlp.EncodeToBytes(envelope); err != nil {
+			t.Fatalf("failed to re-encode decoded envelope: %v", err)
+		}
+	})
+}
@@ -20,21 +20,116 @@ package whisper
 
 import (
 	"crypto/ecdsa"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/aiblocksproject/go-aiblocks/common"
 	"github.com/aiblocksproject/go-aiblocks/event/filter"
 )
 
 // Filter is used to subscribe to specific types of whisper messages.
+//
+// By default the handler is invoked synchronously by the dispatcher, one message
+// at a time, in the order the messages are dispatched. Setting Concurrency above
+// one allows that many handler invocations to run in parallel, dropping any
+// ordering guarantees between them. The node may further cap the parallelism
+// across all of its filters (see Config.MaxHandlers).
+//
+// MinPoW allows a subscription to demand more work than the node requires for
+// relaying: envelopes sealed with less proof of work are still pooled and
+// forwarded, but not delivered to the handler.
+//
+// Senders permits messages from any of a set of keys, e.g. the current and the
+// previous signing keys of a sender rotating its identity. As signatures carry
+// the signer's public key, no key hint is needed to pick the verification key.
+//
+// Since requests a warm-up replay of the matching envelopes retained by the local
+// message store that were sent after the given time. Live messages arriving in
+// the meantime are held back until the replay finishes (up to replayBacklog of
+// them, the oldest ones being dropped beyond that and counted in
+// Stats.ReplayDrops), and those already replayed are not delivered again.
+//
+// ResumeFrom requests the same replay, starting right after a checkpoint taken
+// from a previously delivered message (see Message.Cursor). As checkpoints are
+// positions in the store's arrival sequence, a restarting consumer can resume
+// from one without duplicates or gaps (even if envelopes arrived late with an
+// earlier send time), as long as the store retains the history.
+//
+// Required matches the message topics as a set rather than by position: messages
+// carrying all of the required topics are delivered, whatever their order and
+// whatever other topics they carry. The positional options (Topics, Lenient,
+// Optional and Exact) are then ignored, and the filter cannot be narrowed.
 type Filter struct {
-	To     *ecdsa.PublicKey   // Recipient of the message
-	From   *ecdsa.PublicKey   // Sender of the message
-	Topics [][]Topic          // Topics to filter messages with
-	Fn     func(msg *Message) // Handler in case of a match
+	To          *ecdsa.PublicKey   // Recipient of the message
+	From        *ecdsa.PublicKey   // Sender of the message
+	Senders     []*ecdsa.PublicKey // Permitted senders of the message (any of them)
+	Topics      [][]Topic          // Topics to filter messages with
+	Fn          func(msg *Message) // Handler in case of a match
+	Concurrency int                // Maximum number of parallel handler invocations (0 = 1)
+	MinPoW      float64            // Minimum proof of work required for delivery
+	Lenient     bool               // Treat topics missing from shorter messages as wild-cards
+	Optional    int                // Number of trailing topic conditions shorter messages may omit
+	Exact       bool               // Reject messages carrying more (or fewer) topics than the conditions
+	Required    []Topic            // Topics messages must all carry in any order, matched as a set instead of Topics
+	SkipEmpty   bool               // Suppress (but count) the delivery of empty payload messages, e.g. keepalives
+	Since       time.Time          // Replay stored messages sent after this time (zero = no replay)
+	ResumeFrom  StoreCursor        // Replay stored messages positioned after this checkpoint (zero = no replay)
 }
 
 // NewFilterTopics creates a 2D topic array used by whisper.Filter from binary
 // data elements.
 func NewFilterTopics(data ...[][]byte) [][]Topic {
+	return newSaltedFilterTopics(nil, data...)
+}
+
+// NewFacetFilterTopics creates a 2D topic array used by whisper.Filter from the
+// facet schema of the messages (all facet keys they carry) and the values some
+// of those facets are constrained to. Slots follow the sorted key order of the
+// schema, unconstrained keys becoming wild-cards. Constraints on keys missing
+// from the schema (e.g. misspelled ones) are rejected, as ignoring them would
+// silently broaden the filter.
+func NewFacetFilterTopics(schema []string, constraints map[string]string) ([][]Topic, error) {
+	return newSaltedFacetFilterTopics(nil, schema, constraints)
+}
+
+// newSaltedFacetFilterTopics creates a 2D topic array used by whisper.Filter from
+// the facet schema of the messages and their constraints, salting each topic.
+func newSaltedFacetFilterTopics(salt []byte, schema []string, constraints map[string]string) ([][]Topic, error) {
+	keys := append([]string{}, schema...)
+	sort.Strings(keys)
+
+	// Ensure all the constraints are on facets of the schema
+	known := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		known[key] = struct{}{}
+	}
+	var unknown []string
+	for key := range constraints {
+		if _, ok := known[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("facet %q: %v", unknown[0], ErrUnknownFacet)
+	}
+	// Assemble the filter, unconstrained facets becoming wild-cards
+	filter := make([][]Topic, len(keys))
+	for i, key := range keys {
+		if value, ok := constraints[key]; ok {
+			filter[i] = []Topic{newSaltedFacetTopic(salt, key, value)}
+		} else {
+			filter[i] = []Topic{}
+		}
+	}
+	return filter, nil
+}
+
+// newSaltedFilterTopics creates a 2D topic array used by whisper.Filter from
+// binary data elements, salting each derived topic.
+func newSaltedFilterTopics(salt []byte, data ...[][]byte) [][]Topic {
 	filter := make([][]Topic, len(data))
 	for i, condition := range data {
 		// Handle the special case of condition == [[]byte{}]
@@ -43,17 +138,167 @@ func NewFilterTopics(data ...[][]byte) [][]Topic {
 			continue
 		}
 		// Otherwise flatten normally
-		filter[i] = NewTopics(condition...)
+		filter[i] = newSaltedTopics(salt, condition...)
 	}
 	return filter
 }
 
+// Coalesce wraps a message handler so that out of all the messages sharing the
+// same key (as reported by keyFn) within a time window, only the last one gets
+// delivered. The window is opened by the first message of a key and the handler
+// is invoked once it elapses. The returned function is meant to be used as the
+// Fn of a Filter, collapsing high frequency state updates (e.g. presence).
+func Coalesce(keyFn func(*Message) string, window time.Duration, fn func(*Message)) func(*Message) {
+	return newCoalescer(keyFn, window, fn).handle
+}
+
+// coalescer is the internal state of a coalescing message handler.
+type coalescer struct {
+	keyFn  func(*Message) string
+	window time.Duration
+	fn     func(*Message)
+
+	schedule func(time.Duration, func()) // Delayed execution (time.AfterFunc unless testing)
+	pending  map[string]*Message         // Last message per key within the open windows
+	lock     sync.Mutex
+}
+
+// newCoalescer creates a coalescing message handler around fn.
+func newCoalescer(keyFn func(*Message) string, window time.Duration, fn func(*Message)) *coalescer {
+	return &coalescer{
+		keyFn:  keyFn,
+		window: window,
+		fn:     fn,
+		schedule: func(delay time.Duration, f func()) {
+			time.AfterFunc(delay, f)
+		},
+		pending: make(map[string]*Message),
+	}
+}
+
+// handle records a message as the latest of its key, opening a new delivery
+// window if none is currently active for it.
+func (self *coalescer) handle(msg *Message) {
+	key := self.keyFn(msg)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, ok := self.pending[key]; !ok {
+		self.schedule(self.window, func() { self.flush(key) })
+	}
+	self.pending[key] = msg
+}
+
+// flush delivers the last message received for a key and closes its window.
+func (self *coalescer) flush(key string) {
+	self.lock.Lock()
+	msg := self.pending[key]
+	delete(self.pending, key)
+	self.lock.Unlock()
+
+	if msg != nil {
+		self.fn(msg)
+	}
+}
+
+// replayer wraps a message handler, holding back live messages while a history
+// of stored ones is delivered, and filtering out live duplicates of them.
+type replayer struct {
+	fn func(*Message) // Handler to deliver both replayed and live messages to
+
+	replaying bool                     // Whether the history is still being delivered
+	pending   *common.BoundedBuffer    // Live messages held back during the replay (oldest dropped once full)
+	replayed  map[common.Hash]struct{} // Hashes of the messages already replayed
+	lock      sync.Mutex               // Mutex to sync the replay state
+}
+
+// newReplayer creates a replaying handler, holding back live messages until the
+// history is delivered via replay.
+func newReplayer(fn func(*Message)) *replayer {
+	return &replayer{
+		fn:        fn,
+		replaying: true,
+		pending:   common.NewBoundedBuffer(replayBacklog, common.DropOldest),
+		replayed:  make(map[common.Hash]struct{}),
+	}
+}
+
+// live is the handler of the messages arriving from the network.
+func (self *replayer) live(msg *Message) {
+	self.lock.Lock()
+	if self.replaying {
+		self.pending.Push(msg)
+		self.lock.Unlock()
+		return
+	}
+	_, dup := self.replayed[msg.Hash]
+	self.lock.Unlock()
+
+	if !dup {
+		self.fn(msg)
+	}
+}
+
+// replay delivers a history of messages, followed by all the live ones held back
+// in the meantime, after which live messages are passed through directly.
+func (self *replayer) replay(history []*Message) {
+	for _, msg := range history {
+		self.lock.Lock()
+		self.replayed[msg.Hash] = struct{}{}
+		self.lock.Unlock()
+
+		self.fn(msg)
+	}
+	for {
+		self.lock.Lock()
+		if self.pending.Len() == 0 {
+			self.replaying = false
+			self.lock.Unlock()
+			return
+		}
+		self.lock.Unlock()
+
+		for item, ok := self.pending.Pop(); ok; item, ok = self.pending.Pop() {
+			msg := item.(*Message)
+			if _, dup := self.replayed[msg.Hash]; !dup {
+				self.fn(msg)
+			}
+		}
+	}
+}
+
+// concurrent wraps a message handler so that up to limit invocations may run in
+// parallel. If shared slots are given, each invocation also needs one of those,
+// bounding the parallelism across all the handlers sharing them. Once either
+// limit is reached, delivery blocks until a slot frees up.
+func concurrent(limit int, shared chan struct{}, fn func(*Message)) func(*Message) {
+	slots := make(chan struct{}, limit)
+	return func(msg *Message) {
+		slots <- struct{}{}
+		if shared != nil {
+			shared <- struct{}{}
+		}
+		go func() {
+			defer func() {
+				if shared != nil {
+					<-shared
+				}
+				<-slots
+			}()
+			fn(msg)
+		}()
+	}
+}
+
 // filterer is the internal, fully initialized filter ready to match inbound
 // messages to a variety of criteria.
 type filterer struct {
 	to      string                 // Recipient of the message
 	from    string                 // Sender of the message
+	senders map[string]struct{}    // Permitted senders of the message
 	matcher *topicMatcher          // Topics to filter messages with
+	pow     float64                // Proof of work (minimum on handlers, actual on messages)
 	fn      func(data interface{}) // Handler in case of a match
 }
 
@@ -68,6 +313,15 @@ func (self filterer) Compare(f filter.Filter) bool {
 	if len(self.from) > 0 && self.from != filter.from {
 		return false
 	}
+	if len(self.senders) > 0 {
+		if _, ok := self.senders[filter.from]; !ok {
+			return false
+		}
+	}
+	// Check the proof of work requirement
+	if self.pow > 0 && filter.pow < self.pow {
+		return false
+	}
 	// Check the topic filtering
 	topics := make([]Topic, len(filter.matcher.conditions))
 	for i, group := range filter.matcher.conditions {
@@ -18,8 +18,16 @@ package whisper
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"testing"
+
+	"github.com/aiblocksproject/go-aiblocks/common"
+	"github.com/aiblocksproject/go-aiblocks/crypto"
 )
 
 var filterTopicsCreationTests = []struct {
@@ -214,6 +222,164 @@ func TestFilterCompare(t *testing.T) {
 	}
 }
 
+func TestCoalesce(t *testing.T) {
+	// Create a coalescing handler with a manually driven clock
+	var delivered []*Message
+	coalescer := newCoalescer(func(msg *Message) string { return string(msg.Payload[:1]) }, time.Second, func(msg *Message) {
+		delivered = append(delivered, msg)
+	})
+	var timers []func()
+	coalescer.schedule = func(delay time.Duration, f func()) {
+		if delay != time.Second {
+			t.Errorf("window mismatch: have %v, want %v", delay, time.Second)
+		}
+		timers = append(timers, f)
+	}
+	// Feed multiple updates for two keys within the window
+	updates := []*Message{
+		NewMessage([]byte("a1")), NewMessage([]byte("b1")), NewMessage([]byte("a2")),
+		NewMessage([]byte("a3")), NewMessage([]byte("b2")),
+	}
+	for _, msg := range updates {
+		coalescer.handle(msg)
+	}
+	if len(delivered) != 0 {
+		t.Fatalf("delivered before window elapsed: %d messages", len(delivered))
+	}
+	if len(timers) != 2 {
+		t.Fatalf("window count mismatch: have %d, want %d", len(timers), 2)
+	}
+	// Elapse the windows and check that only the last updates got delivered
+	for _, timer := range timers {
+		timer()
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("delivery count mismatch: have %d, want %d", len(delivered), 2)
+	}
+	if delivered[0] != updates[3] || delivered[1] != updates[4] {
+		t.Fatalf("delivered messages mismatch: have %s, %s; want a3, b2", delivered[0].Payload, delivered[1].Payload)
+	}
+	// Send a new update and ensure it opens a fresh window
+	coalescer.handle(NewMessage([]byte("a4")))
+	if len(timers) != 3 {
+		t.Fatalf("window count mismatch: have %d, want %d", len(timers), 3)
+	}
+	timers[2]()
+	if len(delivered) != 3 || string(delivered[2].Payload) != "a4" {
+		t.Fatalf("post-window delivery mismatch: have %d messages", len(delivered))
+	}
+}
+
+func TestFilterConcurrency(t *testing.T) {
+	for _, concurrency := range []int{0, 3} {
+		limit := concurrency
+		if limit == 0 {
+			limit = 1
+		}
+		node := New()
+
+		// Install a handler blocking until released, tracking the parallel invocations
+		var (
+			active, peak int32
+			started      = make(chan struct{}, limit+2)
+			release      = make(chan struct{})
+		)
+		filter := node.filters.Get(node.Watch(Filter{
+			Concurrency: concurrency,
+			Fn: func(msg *Message) {
+				now := atomic.AddInt32(&active, 1)
+				for old := atomic.LoadInt32(&peak); now > old && !atomic.CompareAndSwapInt32(&peak, old, now); {
+					old = atomic.LoadInt32(&peak)
+				}
+				started <- struct{}{}
+				<-release
+				atomic.AddInt32(&active, -1)
+			},
+		}))
+		go func() {
+			for i := 0; i < limit+2; i++ {
+				filter.Trigger(NewMessage([]byte{byte(i)}))
+			}
+		}()
+		// Ensure exactly limit handlers start, the rest waiting for a free slot
+		for i := 0; i < limit; i++ {
+			select {
+			case <-started:
+			case <-time.After(time.Second):
+				t.Fatalf("concurrency %d: handler %d: blocked by running siblings", concurrency, i)
+			}
+		}
+		select {
+		case <-started:
+			t.Fatalf("concurrency %d: handler started beyond the limit", concurrency)
+		case <-time.After(50 * time.Millisecond):
+		}
+		// Release the handlers one by one, each admitting exactly one waiting handler
+		for i := 0; i < 2; i++ {
+			release <- struct{}{}
+			select {
+			case <-started:
+			case <-time.After(time.Second):
+				t.Fatalf("concurrency %d: waiting handler %d not admitted on release", concurrency, i)
+			}
+			select {
+			case <-started:
+				t.Fatalf("concurrency %d: multiple handlers admitted on a single release", concurrency)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		close(release)
+
+		if have := atomic.LoadInt32(&peak); int(have) != limit {
+			t.Fatalf("concurrency %d: peak parallelism mismatch: have %d, want %d", concurrency, have, limit)
+		}
+	}
+}
+
+func TestFilterMaxHandlers(t *testing.T) {
+	node := NewWithConfig(Config{MaxHandlers: 2})
+
+	// Install a batch of slow parallel handlers sharing the node wide cap
+	started, release := make(chan struct{}, 4), make(chan struct{})
+	ids := make([]int, 4)
+	for i := range ids {
+		ids[i] = node.Watch(Filter{
+			Concurrency: 4,
+			Fn: func(msg *Message) {
+				started <- struct{}{}
+				<-release
+			},
+		})
+	}
+	// Trigger them from the background, as delivery blocks on the node wide cap
+	go func() {
+		for _, id := range ids {
+			node.filters.Get(id).Trigger(NewMessage([]byte("bounded")))
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("handler %d: failed to start", i)
+		}
+	}
+	select {
+	case <-started:
+		t.Fatalf("handler started beyond the node wide cap")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Release the running handlers and ensure the rest get their turn
+	close(release)
+	for i := 2; i < len(ids); i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("handler %d: failed to start after release", i)
+		}
+	}
+}
+
 // NewFilterTopicsFlat creates a 2D topic array used by whisper.Filter from flat
 // binary data elements.
 func newFilterTopicsFlat(data ...[]byte) [][]Topic {
@@ -257,3 +423,314 @@ func newFilterTopicsFromStringsFlat(data ...string) [][]Topic {
 	}
 	return filter
 }
+
+func TestFilterSenders(t *testing.T) {
+	node := New()
+
+	// Generate the rotated signing keys of a sender, and an unrelated one
+	previous, _ := crypto.GenerateKey()
+	current, _ := crypto.GenerateKey()
+	stranger, _ := crypto.GenerateKey()
+
+	matched, unmatched := make(chan *Message, 1), make(chan *Message, 1)
+	node.Watch(Filter{
+		Senders: []*ecdsa.PublicKey{&previous.PublicKey, &current.PublicKey},
+		Fn:      func(msg *Message) { matched <- msg },
+	})
+	node.Watch(Filter{
+		Senders: []*ecdsa.PublicKey{&stranger.PublicKey},
+		Fn:      func(msg *Message) { unmatched <- msg },
+	})
+	// Send a message signed with the rotated key and check where it's delivered
+	envelope, err := NewMessage([]byte("rotated")).Wrap(DefaultPoW, Options{From: current})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if err := node.Send(envelope); err != nil {
+		t.Fatalf("failed to send envelope: %v", err)
+	}
+	select {
+	case msg := <-matched:
+		if signer := msg.Recover(); !bytes.Equal(crypto.FromECDSAPub(signer), crypto.FromECDSAPub(&current.PublicKey)) {
+			t.Fatalf("signer mismatch: have %v, want %v", signer, &current.PublicKey)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered to the permitted senders")
+	}
+	select {
+	case <-unmatched:
+		t.Fatalf("message delivered to foreign senders")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestFilterNarrow(t *testing.T) {
+	node := New()
+
+	delivered := make(chan *Message, 10)
+	id := node.Watch(Filter{
+		Topics: newFilterTopicsFromStrings([]string{"a", "b"}),
+		Fn:     func(msg *Message) { delivered <- msg },
+	})
+	// Ensure broadening or unknown filters are rejected
+	if err := node.Narrow(id, newFilterTopicsFromStrings([]string{"a", "c"})); err != ErrNotNarrower {
+		t.Fatalf("broadening error mismatch: have %v, want %v", err, ErrNotNarrower)
+	}
+	if err := node.Narrow(id+1, newFilterTopicsFromStrings([]string{"a"})); err != ErrUnknownFilter {
+		t.Fatalf("unknown filter error mismatch: have %v, want %v", err, ErrUnknownFilter)
+	}
+	// Narrow the filter and ensure only the still matching messages are delivered
+	if err := node.Narrow(id, newFilterTopicsFromStrings([]string{"a"})); err != nil {
+		t.Fatalf("failed to narrow filter: %v", err)
+	}
+	for _, topic := range []string{"b", "a"} {
+		envelope, err := NewMessage([]byte(topic)).Wrap(DefaultPoW, Options{Topics: newTopicsFromStrings(topic)})
+		if err != nil {
+			t.Fatalf("failed to wrap message: %v", err)
+		}
+		if err := node.Send(envelope); err != nil {
+			t.Fatalf("failed to send envelope: %v", err)
+		}
+	}
+	select {
+	case msg := <-delivered:
+		if string(msg.Payload) != "a" {
+			t.Fatalf("delivered payload mismatch: have %q, want %q", msg.Payload, "a")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("still matching message not delivered")
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("excluded message delivered: %q", msg.Payload)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestFilterExact(t *testing.T) {
+	node := New()
+
+	delivered := make(chan *Message, 10)
+	id := node.Watch(Filter{
+		Topics: newFilterTopicsFromStringsFlat("a", "b"),
+		Exact:  true,
+		Fn:     func(msg *Message) { delivered <- msg },
+	})
+	// Send shorter, longer and exactly matching messages, expecting only the latter
+	for _, topics := range [][]string{{"a"}, {"a", "b", "c"}, {"a", "b"}} {
+		envelope, err := NewMessage([]byte(strings.Join(topics, ""))).Wrap(DefaultPoW, Options{Topics: newTopicsFromStrings(topics...)})
+		if err != nil {
+			t.Fatalf("failed to wrap message: %v", err)
+		}
+		if err := node.Send(envelope); err != nil {
+			t.Fatalf("failed to send envelope: %v", err)
+		}
+	}
+	select {
+	case msg := <-delivered:
+		if string(msg.Payload) != "ab" {
+			t.Fatalf("delivered payload mismatch: have %q, want %q", msg.Payload, "ab")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("exactly matching message not delivered")
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("inexact message delivered: %q", msg.Payload)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Narrow the filter and ensure it stays exact
+	if err := node.Narrow(id, newFilterTopicsFromStringsFlat("a", "b")); err != nil {
+		t.Fatalf("failed to narrow exact filter: %v", err)
+	}
+	if !node.filters.Get(id).(filterer).matcher.exact {
+		t.Fatalf("narrowed filter no longer exact")
+	}
+}
+
+func TestFilterRequired(t *testing.T) {
+	node := New()
+
+	delivered := make(chan *Message, 10)
+	id := node.Watch(Filter{
+		Required: newTopicsFromStrings("a", "b"),
+		Fn:       func(msg *Message) { delivered <- msg },
+	})
+	if topics := node.Stats().MatcherTopics; topics != 2 {
+		t.Fatalf("matcher topic count mismatch: have %d, want %d", topics, 2)
+	}
+	// Send a reordered superset and one missing a required topic, expecting only the former
+	for _, topics := range [][]string{{"a", "c"}, {"c", "b", "a"}} {
+		envelope, err := NewMessage([]byte(strings.Join(topics, ""))).Wrap(DefaultPoW, Options{Topics: newTopicsFromStrings(topics...)})
+		if err != nil {
+			t.Fatalf("failed to wrap message: %v", err)
+		}
+		if err := node.Send(envelope); err != nil {
+			t.Fatalf("failed to send envelope: %v", err)
+		}
+	}
+	select {
+	case msg := <-delivered:
+		if string(msg.Payload) != "cba" {
+			t.Fatalf("delivered payload mismatch: have %q, want %q", msg.Payload, "cba")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("matching message not delivered")
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("incomplete message delivered: %q", msg.Payload)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Ensure the filter can't be narrowed into a positional one
+	if err := node.Narrow(id, newFilterTopicsFromStringsFlat("a", "b")); err != ErrUnorderedFilter {
+		t.Fatalf("narrowing error mismatch: have %v, want %v", err, ErrUnorderedFilter)
+	}
+	if node.filters.Get(id).(filterer).matcher.required == nil {
+		t.Fatalf("filter no longer unordered")
+	}
+}
+
+func TestFilterReceipts(t *testing.T) {
+	receipts := new(bytes.Buffer)
+	node := NewWithConfig(Config{Receipts: receipts})
+
+	delivered := make(chan *Message, 1)
+	id := node.Watch(Filter{
+		Topics: newFilterTopicsFromStringsFlat("audited"),
+		Fn:     func(msg *Message) { delivered <- msg },
+	})
+	envelope, err := NewMessage([]byte("audited")).Wrap(DefaultPoW, Options{Topics: newTopicsFromStrings("audited")})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if err := node.Send(envelope); err != nil {
+		t.Fatalf("failed to send envelope: %v", err)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatalf("message delivery timeout")
+	}
+	// Ensure the delivery was audited with the envelope hash and filter id
+	fields := strings.Fields(receipts.String())
+	if len(fields) != 3 {
+		t.Fatalf("receipt format mismatch: have %q, want 3 fields", receipts.String())
+	}
+	if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		t.Errorf("receipt timestamp invalid: %v", err)
+	}
+	if want := fmt.Sprintf("%x", envelope.Hash()); fields[1] != want {
+		t.Errorf("receipt hash mismatch: have %s, want %s", fields[1], want)
+	}
+	if want := fmt.Sprintf("%d", id); fields[2] != want {
+		t.Errorf("receipt filter id mismatch: have %s, want %s", fields[2], want)
+	}
+}
+
+func TestFilterSkipEmpty(t *testing.T) {
+	node := New()
+
+	delivered := make(chan *Message, 2)
+	node.Watch(Filter{
+		Topics:    newFilterTopicsFromStringsFlat("presence"),
+		Fn:        func(msg *Message) { delivered <- msg },
+		SkipEmpty: true,
+	})
+	// Send a keepalive followed by a real message, and ensure only the latter arrives
+	for _, payload := range []string{"", "online"} {
+		envelope, err := NewMessage([]byte(payload)).Wrap(DefaultPoW, Options{Topics: newTopicsFromStrings("presence")})
+		if err != nil {
+			t.Fatalf("failed to wrap message: %v", err)
+		}
+		if err := node.Send(envelope); err != nil {
+			t.Fatalf("failed to send envelope: %v", err)
+		}
+	}
+	select {
+	case msg := <-delivered:
+		if string(msg.Payload) != "online" {
+			t.Fatalf("delivered payload mismatch: have %q, want %q", msg.Payload, "online")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message delivery timeout")
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("unexpected delivery: %q", msg.Payload)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// The keepalive may be dispatched after the real message, allow it some time
+	for start := time.Now(); node.Stats().EmptySkips == 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	if skips := node.Stats().EmptySkips; skips != 1 {
+		t.Fatalf("suppressed keepalive count mismatch: have %d, want %d", skips, 1)
+	}
+}
+
+func TestReplayerBacklog(t *testing.T) {
+	var delivered []*Message
+	replay := newReplayer(func(msg *Message) { delivered = append(delivered, msg) })
+
+	// Hold back more live messages than the backlog fits during the replay
+	history := []*Message{{Hash: common.BytesToHash([]byte("history"))}}
+	live := make([]*Message, replayBacklog+10)
+	for i := range live {
+		live[i] = &Message{Hash: common.BytesToHash([]byte(fmt.Sprintf("live %d", i)))}
+		replay.live(live[i])
+	}
+	replay.live(history[0])
+	replay.replay(history)
+
+	// Ensure the oldest live messages were dropped, and the rest delivered in order
+	want := append(history, live[11:]...)
+	if len(delivered) != len(want) {
+		t.Fatalf("delivered message count mismatch: have %d, want %d", len(delivered), len(want))
+	}
+	for i := range want {
+		if delivered[i] != want[i] {
+			t.Fatalf("message %d: delivery mismatch: have %x, want %x", i, delivered[i].Hash, want[i].Hash)
+		}
+	}
+	if dropped := replay.pending.Dropped(); dropped != 11 {
+		t.Fatalf("dropped message count mismatch: have %d, want %d", dropped, 11)
+	}
+	// Ensure live messages pass through directly once the replay is done
+	replay.live(live[0])
+	if last := delivered[len(delivered)-1]; last != live[0] {
+		t.Fatalf("post replay delivery mismatch: have %x, want %x", last.Hash, live[0].Hash)
+	}
+}
+
+func TestFacetFilterTopics(t *testing.T) {
+	schema := []string{"room", "lang", "kind"}
+	topics, err := NewFacetFilterTopics(schema, map[string]string{"room": "lobby", "kind": "chat"})
+	if err != nil {
+		t.Fatalf("failed to create facet filter: %v", err)
+	}
+	matcher := newTopicMatcher(topics...)
+
+	tests := []struct {
+		facets map[string]string
+		match  bool
+	}{
+		{map[string]string{"room": "lobby", "lang": "en", "kind": "chat"}, true},  // constrained facets match
+		{map[string]string{"room": "lobby", "lang": "de", "kind": "chat"}, true},  // unconstrained facet is wild-card
+		{map[string]string{"room": "attic", "lang": "en", "kind": "chat"}, false}, // constrained facet mismatch
+		{map[string]string{"room": "lobby", "lang": "en", "kind": "ping"}, false}, // other constrained facet mismatch
+	}
+	for i, tt := range tests {
+		if match := matcher.Matches(NewFacetTopics(tt.facets)); match != tt.match {
+			t.Errorf("test %d: match mismatch: have %v, want %v", i, match, tt.match)
+		}
+	}
+	// Ensure facet topics are derived from the key=value form
+	if NewFacetTopic("room", "lobby") != NewTopic([]byte("room=lobby")) {
+		t.Errorf("facet topic derivation mismatch")
+	}
+	// Ensure constraints on facets outside the schema are rejected
+	if _, err := NewFacetFilterTopics(schema, map[string]string{"room": "lobby", "knd": "chat"}); err == nil || !strings.Contains(err.Error(), ErrUnknownFacet.Error()) {
+		t.Errorf("misspelled facet error mismatch: have %v, want %v", err, ErrUnknownFacet)
+	}
+}
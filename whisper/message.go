@@ -20,8 +20,11 @@
 package whisper
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/aiblocksproject/go-aiblocks/common"
@@ -36,15 +39,58 @@ import (
 type Message struct {
 	Flags     byte // First bit is signature presence, rest reserved and should be random
 	Signature []byte
+	ReplyTo   Topic  // Topic on which the recipient should reply (optional)
+	Type      string // Short tag describing the payload encoding, e.g. "json" (optional)
 	Payload   []byte
 
 	Sent time.Time     // Time when the message was posted into the network
 	TTL  time.Duration // Maximum time to live allowed for the message
+	PoW  float64       // Proof of work the message envelope was sealed with
+
+	Topics []Topic // Topics of the envelope the message arrived in
 
 	To   *ecdsa.PublicKey // Message recipient (identity used to decode the message)
 	Hash common.Hash      // Message envelope hash to act as a unique id
+
+	cursor StoreCursor    // Message store checkpoint of the envelope (zero if not stored)
+	expiry *messageExpiry // Local expiry signal, armed on first use
+}
+
+// clock is the time source of the timing dependent features, replaceable so that
+// tests can drive them manually.
+type clock struct {
+	now      func() time.Time            // Current time (time.Now unless testing)
+	schedule func(time.Duration, func()) // Delayed execution (time.AfterFunc unless testing)
+}
+
+// realClock is the wall clock used outside of tests.
+var realClock = &clock{
+	now: time.Now,
+	schedule: func(delay time.Duration, f func()) {
+		time.AfterFunc(delay, f)
+	},
 }
 
+// messageExpiry is the local expiry signal of a message, created and armed only
+// once the message's expiry is first requested.
+type messageExpiry struct {
+	clock   *clock
+	expired chan struct{}
+	once    sync.Once
+}
+
+// newMessageExpiry creates an unarmed expiry signal timed by the given clock.
+func newMessageExpiry(clock *clock) *messageExpiry {
+	return &messageExpiry{clock: clock}
+}
+
+// payloadHeader is the magic (and version) prefixing the payload of messages that
+// carry optional fields within it, followed by a byte announcing the fields. The
+// fields are thus sealed by the signature and the encryption, and legacy nodes see
+// them as part of the payload. The flag bits beyond the signature are random on
+// legacy messages, so they can't announce optional fields.
+var payloadHeader = []byte{'s', 'h', 'h', 0x01}
+
 // Options specifies the exact way a message should be wrapped into an Envelope.
 type Options struct {
 	From   *ecdsa.PrivateKey
@@ -64,7 +110,50 @@ func NewMessage(payload []byte) *Message {
 		Flags:   flags,
 		Payload: payload,
 		Sent:    time.Now(),
+		expiry:  newMessageExpiry(realClock),
+	}
+}
+
+// Cursor retrieves the message store checkpoint of the message, from which a
+// consumer can later resume its stored history (see Filter.ResumeFrom). It is
+// zero for messages not retained by the local store (e.g. ephemeral ones).
+func (self *Message) Cursor() StoreCursor {
+	return self.cursor
+}
+
+// Expiry returns a channel that is closed once the message's time to live has
+// elapsed locally, e.g. to drop state tied to it. Messages delivered by a node
+// are timed by its clock. The channel is created on the first call and shared
+// by all later ones. It is nil, thus never closed, for messages not created via
+// NewMessage or opened from an envelope.
+func (self *Message) Expiry() <-chan struct{} {
+	if self.expiry == nil {
+		return nil
+	}
+	self.expiry.once.Do(func() {
+		expired := make(chan struct{})
+		if delay := self.Sent.Add(self.TTL).Sub(self.expiry.clock.now()); delay > 0 {
+			self.expiry.clock.schedule(delay, func() { close(expired) })
+		} else {
+			close(expired)
+		}
+		self.expiry.expired = expired
+	})
+	return self.expiry.expired
+}
+
+// GroupByTopic buckets a list of messages by the first topic of the envelopes
+// they arrived in, skipping messages without topics. The messages retain their
+// original order within each bucket.
+func GroupByTopic(msgs []*Message) map[Topic][]*Message {
+	groups := make(map[Topic][]*Message)
+	for _, msg := range msgs {
+		if len(msg.Topics) == 0 {
+			continue
+		}
+		groups[msg.Topics[0]] = append(groups[msg.Topics[0]], msg)
 	}
+	return groups
 }
 
 // Wrap bundles the message into an Envelope to transmit over the network.
@@ -73,6 +162,9 @@ func NewMessage(payload []byte) *Message {
 // inherently controlling its priority through the network (smaller hash, bigger
 // priority).
 //
+// Optional fields carried within the payload (see payloadHeader) are folded into
+// it, so afterwards the message holds the payload as transmitted.
+//
 // The user can control the amount of identity, privacy and encryption through
 // the options parameter as follows:
 //   - options.From == nil && options.To == nil: anonymous broadcast
@@ -86,6 +178,20 @@ func (self *Message) Wrap(pow time.Duration, options Options) (*Envelope, error)
 	}
 	self.TTL = options.TTL
 
+	if len(self.Type) > maxTypeLength {
+		return nil, fmt.Errorf("payload type too long: have %d bytes, want at most %d", len(self.Type), maxTypeLength)
+	}
+	if len(options.Topics) > maxEnvelopeTopics {
+		return nil, fmt.Errorf("too many topics: have %d, want at most %d", len(options.Topics), maxEnvelopeTopics)
+	}
+	for i, topic := range options.Topics {
+		if topic.IsWildcard() {
+			return nil, fmt.Errorf("topic %d: %v", i, ErrWildcardTopic)
+		}
+	}
+	// Fold the optional fields into the payload, sealing them by the signature and encryption
+	self.Payload, self.ReplyTo, self.Type = self.body(), Topic{}, ""
+
 	// Sign and encrypt the message if requested
 	if options.From != nil {
 		if err := self.sign(options.From); err != nil {
@@ -144,13 +250,71 @@ func (self *Message) decrypt(key *ecdsa.PrivateKey) error {
 	return err
 }
 
-// hash calculates the SHA3 checksum of the message flags and payload.
+// hash calculates the SHA3 checksum of the message flags, optional fields and
+// payload.
 func (self *Message) hash() []byte {
-	return crypto.Keccak256(append([]byte{self.Flags}, self.Payload...))
+	return crypto.Keccak256([]byte{self.Flags}, self.body())
 }
 
-// bytes flattens the message contents (flags, signature and payload) into a
-// single binary blob.
+// bytes flattens the message contents (flags, signature, optional fields and
+// payload) into a single binary blob.
 func (self *Message) bytes() []byte {
-	return append([]byte{self.Flags}, append(self.Signature, self.Payload...)...)
+	data := append([]byte{self.Flags}, self.Signature...)
+	return append(data, self.body()...)
+}
+
+// body assembles the payload of the message, prefixed by the header of the
+// optional fields carried within it, if any of them are set.
+func (self *Message) body() []byte {
+	var fields byte
+	if !self.ReplyTo.IsZero() {
+		fields |= headerReplyTo
+	}
+	if self.Type != "" {
+		fields |= headerType
+	}
+	if fields == 0 {
+		return self.Payload
+	}
+	data := append(append([]byte{}, payloadHeader...), fields)
+	if fields&headerReplyTo == headerReplyTo {
+		data = append(data, self.ReplyTo[:]...)
+	}
+	if fields&headerType == headerType {
+		data = append(data, byte(len(self.Type)))
+		data = append(data, self.Type...)
+	}
+	return append(data, self.Payload...)
+}
+
+// unfold extracts the optional fields from the header of a clear-text payload.
+// Payloads without a well formed header, e.g. those of legacy senders, are left
+// verbatim. As the encoding is canonical, body reassembles the exact original.
+func (self *Message) unfold() {
+	data := self.Payload
+	if len(data) <= len(payloadHeader) || !bytes.Equal(data[:len(payloadHeader)], payloadHeader) {
+		return
+	}
+	fields, data := data[len(payloadHeader)], data[len(payloadHeader)+1:]
+	if fields == 0 || fields&^(headerReplyTo|headerType) != 0 {
+		return
+	}
+	var reply Topic
+	if fields&headerReplyTo == headerReplyTo {
+		if len(data) < len(reply) {
+			return
+		}
+		copy(reply[:], data)
+		if data = data[len(reply):]; reply.IsZero() {
+			return
+		}
+	}
+	var kind string
+	if fields&headerType == headerType {
+		if len(data) < 1 || data[0] == 0 || len(data) < 1+int(data[0]) {
+			return
+		}
+		kind, data = string(data[1:1+int(data[0])]), data[1+int(data[0]):]
+	}
+	self.ReplyTo, self.Type, self.Payload = reply, kind, data
 }
@@ -19,6 +19,7 @@ package whisper
 import (
 	"bytes"
 	"crypto/elliptic"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -157,3 +158,234 @@ func TestMessageFullCrypto(t *testing.T) {
 		t.Fatalf("public key mismatch: have 0x%x, want 0x%x", p2, p1)
 	}
 }
+
+// Tests that the optional fields of a message (reply topic and payload type)
+// survive signing, encryption and opening on the recipient side.
+func TestMessageReplyTo(t *testing.T) {
+	sender, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to create sender crypto key: %v", err)
+	}
+	recipient, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to create recipient crypto key: %v", err)
+	}
+	payload := []byte("hello world")
+
+	reply := NewTopic([]byte("reply topic"))
+
+	msg := NewMessage(payload)
+	msg.ReplyTo = reply
+	msg.Type = "application/x-reply-test"
+
+	envelope, err := msg.Wrap(DefaultPoW, Options{
+		From: sender,
+		To:   &recipient.PublicKey,
+	})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	opened, err := envelope.Open(recipient)
+	if err != nil {
+		t.Fatalf("failed to open envelope: %v", err)
+	}
+	if opened.ReplyTo != reply {
+		t.Fatalf("reply topic mismatch: have %x, want %x", opened.ReplyTo, reply)
+	}
+	if opened.Type != "application/x-reply-test" {
+		t.Fatalf("type mismatch: have %q, want %q", opened.Type, "application/x-reply-test")
+	}
+	// Ensure the optional fields travel encrypted, not in the clear
+	if bytes.Contains(envelope.Data, reply[:]) {
+		t.Fatalf("reply topic transmitted in the clear")
+	}
+	if bytes.Contains(envelope.Data, []byte("application/x-reply-test")) {
+		t.Fatalf("payload type transmitted in the clear")
+	}
+	if !bytes.Equal(opened.Payload, payload) {
+		t.Fatalf("payload mismatch: have 0x%x, want 0x%x", opened.Payload, payload)
+	}
+	if pub := opened.Recover(); pub == nil || !bytes.Equal(crypto.FromECDSAPub(pub), crypto.FromECDSAPub(&sender.PublicKey)) {
+		t.Fatalf("signer mismatch: have 0x%x, want 0x%x", crypto.FromECDSAPub(pub), crypto.FromECDSAPub(&sender.PublicKey))
+	}
+}
+
+// Tests that envelopes assembled by legacy senders, with random values in the
+// reserved flag bits, open with their payloads intact.
+func TestMessageLegacyFlags(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		flags := byte(rng.Intn(256)) &^ signatureFlag
+		payload := make([]byte, 1+rng.Intn(64))
+		rng.Read(payload)
+
+		envelope := &Envelope{
+			Expiry: uint32(time.Now().Add(DefaultTTL).Unix()),
+			TTL:    uint32(DefaultTTL.Seconds()),
+			Topics: newTopicsFromStrings("legacy"),
+			Data:   append([]byte{flags}, payload...),
+		}
+		msg, err := envelope.Open(nil)
+		if err != nil {
+			t.Fatalf("envelope %d (flags %08b): failed to open: %v", i, flags, err)
+		}
+		if !bytes.Equal(msg.Payload, payload) {
+			t.Fatalf("envelope %d (flags %08b): payload mismatch: have 0x%x, want 0x%x", i, flags, msg.Payload, payload)
+		}
+		if !msg.ReplyTo.IsZero() || msg.Type != "" {
+			t.Fatalf("envelope %d (flags %08b): phantom optional fields: reply %x, type %q", i, flags, msg.ReplyTo, msg.Type)
+		}
+	}
+}
+
+// Tests that the payload type tag round-trips from wrapping to delivery, and
+// that untagged messages don't carry it.
+func TestMessageType(t *testing.T) {
+	node := New()
+
+	delivered := make(chan *Message, 2)
+	node.Watch(Filter{
+		Topics: newFilterTopicsFromStringsFlat("typed"),
+		Fn:     func(msg *Message) { delivered <- msg },
+	})
+	for _, kind := range []string{"json", ""} {
+		msg := NewMessage([]byte(`{"hello": "world"}`))
+		msg.Type = kind
+
+		envelope, err := msg.Wrap(DefaultPoW, Options{Topics: newTopicsFromStrings("typed")})
+		if err != nil {
+			t.Fatalf("failed to wrap %q message: %v", kind, err)
+		}
+		if err := node.Send(envelope); err != nil {
+			t.Fatalf("failed to send %q message: %v", kind, err)
+		}
+		select {
+		case msg := <-delivered:
+			if msg.Type != kind {
+				t.Fatalf("type mismatch: have %q, want %q", msg.Type, kind)
+			}
+			if string(msg.Payload) != `{"hello": "world"}` {
+				t.Fatalf("payload mismatch: have %q", msg.Payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q message receive timeout", kind)
+		}
+	}
+	// Ensure overly long tags are rejected
+	msg := NewMessage(nil)
+	msg.Type = string(make([]byte, maxTypeLength+1))
+	if _, err := msg.Wrap(DefaultPoW, Options{}); err == nil {
+		t.Fatalf("overly long type accepted")
+	}
+}
+
+// manualClock is a clock driven by the test, firing the scheduled functions once
+// the time is advanced past their deadline.
+type manualClock struct {
+	now    time.Time
+	timers map[time.Time][]func()
+}
+
+func newManualClock(now time.Time) *manualClock {
+	return &manualClock{now: now, timers: make(map[time.Time][]func())}
+}
+
+func (self *manualClock) clock() *clock {
+	return &clock{
+		now: func() time.Time { return self.now },
+		schedule: func(delay time.Duration, f func()) {
+			deadline := self.now.Add(delay)
+			self.timers[deadline] = append(self.timers[deadline], f)
+		},
+	}
+}
+
+func (self *manualClock) advance(delay time.Duration) {
+	self.now = self.now.Add(delay)
+	for deadline, fns := range self.timers {
+		if !deadline.After(self.now) {
+			delete(self.timers, deadline)
+			for _, fn := range fns {
+				fn()
+			}
+		}
+	}
+}
+
+func TestMessageExpiry(t *testing.T) {
+	// Deliver a message through a node driven by a manual clock
+	envelope, err := NewMessage([]byte("expiring")).Wrap(0, Options{TTL: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	node := New()
+	manual := newManualClock(time.Unix(int64(envelope.Expiry-envelope.TTL), 0))
+	node.clock = manual.clock()
+
+	msg := node.open(envelope)
+	expiry := msg.Expiry()
+	if msg.Expiry() != expiry {
+		t.Fatalf("expiry channel not shared between calls")
+	}
+	if len(manual.timers) != 1 {
+		t.Fatalf("armed timer count mismatch: have %d, want %d", len(manual.timers), 1)
+	}
+	// Ensure the channel stays open until right before the expiry, closing at it
+	manual.advance(10*time.Second - time.Nanosecond)
+	select {
+	case <-expiry:
+		t.Fatalf("message expired early")
+	default:
+	}
+	manual.advance(time.Nanosecond)
+	select {
+	case <-expiry:
+	default:
+		t.Fatalf("message not expired at its time to live")
+	}
+	// Ensure already expired messages signal immediately, without arming a timer
+	late := node.open(envelope)
+	select {
+	case <-late.Expiry():
+	default:
+		t.Fatalf("expired message not signalled")
+	}
+	if len(manual.timers) != 0 {
+		t.Fatalf("armed timer count mismatch: have %d, want %d", len(manual.timers), 0)
+	}
+}
+
+func TestGroupByTopic(t *testing.T) {
+	// Open a batch of envelopes with mixed topics
+	var msgs []*Message
+	for i, topics := range [][]string{{"a"}, {"b", "a"}, {}, {"a", "c"}, {"b"}} {
+		envelope, err := NewMessage([]byte{byte(i)}).Wrap(0, Options{Topics: newTopicsFromStrings(topics...)})
+		if err != nil {
+			t.Fatalf("message %d: failed to wrap: %v", i, err)
+		}
+		msg, err := envelope.Open(nil)
+		if err != nil {
+			t.Fatalf("message %d: failed to open: %v", i, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	// Group them by first topic and check the buckets
+	groups := GroupByTopic(msgs)
+	want := map[Topic][]*Message{
+		newTopicFromString("a"): {msgs[0], msgs[3]},
+		newTopicFromString("b"): {msgs[1], msgs[4]},
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("group count mismatch: have %d, want %d", len(groups), len(want))
+	}
+	for topic, bucket := range want {
+		if len(groups[topic]) != len(bucket) {
+			t.Fatalf("topic %x: bucket size mismatch: have %d, want %d", topic, len(groups[topic]), len(bucket))
+		}
+		for i, msg := range bucket {
+			if groups[topic][i] != msg {
+				t.Errorf("topic %x, message %d: mismatch: have %x, want %x", topic, i, groups[topic][i].Payload, msg.Payload)
+			}
+		}
+	}
+}
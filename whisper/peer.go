@@ -18,6 +18,7 @@ package whisper
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/aiblocksproject/go-aiblocks/common"
@@ -36,9 +37,59 @@ type peer struct {
 
 	known *set.Set // Messages already known by the peer to avoid wasting bandwidth
 
+	// Once the exact known set grows past knownExactLimit, further envelopes are
+	// tracked in bloom filters instead. A false positive causes an envelope not
+	// to be forwarded to this peer, which is accepted in exchange for the bounded
+	// memory use; the peer may still receive it from others. To keep the false
+	// positive rate in check under sustained traffic, the filters are rotated in
+	// two generations: once the current one holds knownBloomItems envelopes, it
+	// replaces the previous one and a fresh filter takes its place. Both of them
+	// are dropped when all the envelopes inserted into them have expired.
+	overflow       *common.HashBloom // Bloom filter of known envelopes beyond the exact limit (current generation)
+	overflowPrev   *common.HashBloom // Bloom filter of the previous generation, still consulted
+	overflowItems  int               // Number of envelopes inserted into the current generation
+	overflowExpiry uint32            // Latest expiry of the envelopes inserted into the filters
+	overflowMu     sync.Mutex        // Mutex to sync the overflow bloom filters
+
+	budgets map[Topic]*tokenBucket // Forwarding budgets per first topic (update loop only, idle ones dropped on expiration)
+
 	quit chan struct{}
 }
 
+// tokenBucket is a simple token bucket rate limiter, refilled continuously at a
+// fixed rate up to a burst equal to that rate.
+type tokenBucket struct {
+	rate   float64   // Tokens added per second, also the bucket capacity
+	tokens float64   // Tokens currently available
+	last   time.Time // Time of the last refill
+}
+
+// newTokenBucket creates a full token bucket with the given refill rate.
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take refills the bucket and tries to consume a single token from it.
+func (self *tokenBucket) take(now time.Time) bool {
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	if self.tokens > self.rate {
+		self.tokens = self.rate
+	}
+	self.last = now
+
+	if self.tokens < 1 {
+		return false
+	}
+	self.tokens--
+	return true
+}
+
+// full checks whether the bucket would be refilled to capacity by now, making it
+// indistinguishable from a freshly created one.
+func (self *tokenBucket) full(now time.Time) bool {
+	return self.tokens+now.Sub(self.last).Seconds()*self.rate >= self.rate
+}
+
 // newPeer creates a new whisper peer object, but does not run the handshake itself.
 func newPeer(host *Whisper, remote *p2p.Peer, rw p2p.MsgReadWriter) *peer {
 	return &peer{
@@ -124,12 +175,37 @@ func (self *peer) update() {
 
 // mark marks an envelope known to the peer so that it won't be sent back.
 func (self *peer) mark(envelope *Envelope) {
-	self.known.Add(envelope.Hash())
+	if self.known.Size() < knownExactLimit {
+		self.known.Add(envelope.Hash())
+		return
+	}
+	self.overflowMu.Lock()
+	defer self.overflowMu.Unlock()
+
+	if self.overflow == nil || self.overflowItems >= knownBloomItems {
+		self.overflowPrev = self.overflow
+		self.overflow, self.overflowItems = common.NewHashBloom(knownBloomItems, knownBloomRate), 0
+	}
+	self.overflow.Add(envelope.Hash())
+	self.overflowItems++
+	if envelope.Expiry > self.overflowExpiry {
+		self.overflowExpiry = envelope.Expiry
+	}
 }
 
-// marked checks if an envelope is already known to the remote peer.
+// marked checks if an envelope is already (or probably, if the exact set has
+// overflowed) known to the remote peer.
 func (self *peer) marked(envelope *Envelope) bool {
-	return self.known.Has(envelope.Hash())
+	if self.known.Has(envelope.Hash()) {
+		return true
+	}
+	self.overflowMu.Lock()
+	defer self.overflowMu.Unlock()
+
+	if self.overflow != nil && self.overflow.MayContain(envelope.Hash()) {
+		return true
+	}
+	return self.overflowPrev != nil && self.overflowPrev.MayContain(envelope.Hash())
 }
 
 // expire iterates over all the known envelopes in the host and removes all
@@ -152,24 +228,71 @@ func (self *peer) expire() {
 	for hash := range unmark {
 		self.known.Remove(hash)
 	}
+	// Drop the idle forwarding budgets, recreated full on the next use anyway
+	now := time.Now()
+	for topic, bucket := range self.budgets {
+		if bucket.full(now) {
+			delete(self.budgets, topic)
+		}
+	}
+	// Drop the overflow filters if everything inserted into them already expired
+	self.overflowMu.Lock()
+	if self.overflow != nil && self.overflowExpiry < uint32(now.Unix()) {
+		self.overflow, self.overflowPrev, self.overflowItems, self.overflowExpiry = nil, nil, 0, 0
+	}
+	self.overflowMu.Unlock()
 }
 
 // broadcast iterates over the collection of envelopes and transmits yet unknown
 // ones over the network.
 func (self *peer) broadcast() error {
-	// Fetch the envelopes and collect the unknown ones
+	// Fetch the unknown envelopes and order them by topic priority
 	envelopes := self.host.envelopes()
-	transmit := make([]*Envelope, 0, len(envelopes))
+	pending := make([]*Envelope, 0, len(envelopes))
 	for _, envelope := range envelopes {
 		if !self.marked(envelope) {
+			pending = append(pending, envelope)
+		}
+	}
+	self.host.prioritize(pending)
+
+	// Collect the batch in order within the topic budgets and the cycle limit,
+	// deferring the rest, and transmit it (potentially empty)
+	transmit := make([]*Envelope, 0, len(pending))
+	for _, envelope := range pending {
+		if len(transmit) >= self.host.broadcastLimit {
+			break
+		}
+		if self.budget(envelope) {
 			transmit = append(transmit, envelope)
 			self.mark(envelope)
 		}
 	}
-	// Transmit the unknown batch (potentially empty)
 	if _, err := p2p.Send(self.ws, messagesCode, transmit); err != nil {
 		return err
 	}
 	glog.V(logger.Detail).Infoln(self.peer, "broadcasted", len(transmit), "message(s)")
 	return nil
 }
+
+// budget checks whether the forwarding budget of an envelope's first topic allows
+// transmitting it to the peer now, consuming from the budget if so.
+func (self *peer) budget(envelope *Envelope) bool {
+	if self.host.topicBudget <= 0 {
+		return true
+	}
+	var topic Topic
+	if len(envelope.Topics) > 0 {
+		topic = envelope.Topics[0]
+	}
+	now := time.Now()
+	if self.budgets == nil {
+		self.budgets = make(map[Topic]*tokenBucket)
+	}
+	bucket, ok := self.budgets[topic]
+	if !ok {
+		bucket = newTokenBucket(self.host.topicBudget, now)
+		self.budgets[topic] = bucket
+	}
+	return bucket.take(now)
+}
@@ -17,9 +17,11 @@
 package whisper
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/aiblocksproject/go-aiblocks/common"
 	"github.com/aiblocksproject/go-aiblocks/p2p"
 	"github.com/aiblocksproject/go-aiblocks/p2p/discover"
 )
@@ -164,6 +166,56 @@ func TestPeerSend(t *testing.T) {
 	}
 }
 
+func TestPeerMalformedEnvelope(t *testing.T) {
+	empty := newStoreTestEnvelope(0, "", "a")
+	empty.Data = nil
+
+	wildcard := newStoreTestEnvelope(0, "wildcard", "a")
+	wildcard.Topics = append(wildcard.Topics, Topic{})
+
+	crowded := newStoreTestEnvelope(0, "crowded")
+	for i := 0; i <= maxEnvelopeTopics; i++ {
+		crowded.Topics = append(crowded.Topics, newTopicFromString(fmt.Sprintf("topic %d", i)))
+	}
+	tests := []*Envelope{
+		newStoreTestEnvelope(0, "", "a"), // flags only, valid
+		empty,
+		wildcard,
+		crowded,
+	}
+	for i, envelope := range tests {
+		tester, err := startTestPeerInited()
+		if err != nil {
+			t.Fatalf("test %d: failed to start initialized peer: %v", i, err)
+		}
+		go func() {
+			for {
+				if _, err := tester.stream.ReadMsg(); err != nil {
+					return
+				}
+			}
+		}()
+		if _, err := p2p.Send(tester.stream, messagesCode, []*Envelope{envelope}); err != nil {
+			t.Fatalf("test %d: failed to relay envelope: %v", i, err)
+		}
+		// Ensure the peer stays connected, but only valid envelopes get pooled
+		select {
+		case <-tester.termed:
+			t.Fatalf("test %d: relayed envelope disconnected the peer", i)
+		case <-time.After(100 * time.Millisecond):
+		}
+		want := 0
+		if i == 0 {
+			want = 1
+		}
+		if pooled := len(tester.client.envelopes()); pooled != want {
+			t.Fatalf("test %d: pooled envelope count mismatch: have %d, want %d", i, pooled, want)
+		}
+		tester.stream.Close()
+		<-tester.termed
+	}
+}
+
 func TestPeerDeliver(t *testing.T) {
 	// Start a tester and execute the handshake
 	tester, err := startTestPeerInited()
@@ -259,3 +311,265 @@ func TestPeerMessageExpiration(t *testing.T) {
 		t.Fatalf("message not expired from cache")
 	}
 }
+
+func TestPeerBroadcastPriority(t *testing.T) {
+	// Create an earlier bulk and a later control envelope
+	bulk := newStoreTestEnvelope(-10*time.Second, "bulk", "bulk")
+	control := newStoreTestEnvelope(0, "control", "control")
+
+	tests := []struct {
+		priorities map[Topic]int
+		order      []interface{}
+	}{
+		{nil, []interface{}{bulk, control}}, // default, oldest first
+		{map[Topic]int{newTopicFromString("control"): 1}, []interface{}{control, bulk}},
+	}
+	for i, tt := range tests {
+		node := NewWithConfig(Config{TopicPriorities: tt.priorities})
+		for _, envelope := range []*Envelope{bulk, control} {
+			if err := node.Send(envelope); err != nil {
+				t.Fatalf("test %d: failed to send envelope: %v", i, err)
+			}
+		}
+		// Broadcast the pool to a simulated peer and check the transmission order
+		tester, tested := p2p.MsgPipe()
+		peer := newPeer(node, p2p.NewPeer(discover.NodeID{}, "", nil), tested)
+
+		errc := make(chan error, 1)
+		go func() { errc <- peer.broadcast() }()
+
+		if err := p2p.ExpectMsg(tester, messagesCode, tt.order); err != nil {
+			t.Fatalf("test %d: transmission mismatch: %v", i, err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("test %d: broadcast failed: %v", i, err)
+		}
+		tester.Close()
+	}
+}
+
+// broadcastTestPeer runs a single broadcast cycle of a peer into a simulated
+// remote end, returning the hashes of the transmitted envelopes in order.
+func broadcastTestPeer(node *Whisper) (*peer, func() ([]common.Hash, error)) {
+	tester, tested := p2p.MsgPipe()
+	peer := newPeer(node, p2p.NewPeer(discover.NodeID{}, "", nil), tested)
+
+	return peer, func() ([]common.Hash, error) {
+		errc := make(chan error, 1)
+		go func() { errc <- peer.broadcast() }()
+
+		packet, err := tester.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		var envelopes []*Envelope
+		if err := packet.Decode(&envelopes); err != nil {
+			return nil, err
+		}
+		if err := <-errc; err != nil {
+			return nil, err
+		}
+		hashes := make([]common.Hash, len(envelopes))
+		for i, envelope := range envelopes {
+			hashes[i] = envelope.Hash()
+		}
+		return hashes, nil
+	}
+}
+
+func TestPeerBroadcastDeferral(t *testing.T) {
+	// Create an earlier bulk and a later control envelope, sharing a first topic
+	bulk := newStoreTestEnvelope(-10*time.Second, "bulk", "shared", "bulk")
+	control := newStoreTestEnvelope(0, "control", "shared", "control")
+	priorities := map[Topic]int{newTopicFromString("control"): 1}
+
+	tests := []struct {
+		config Config
+	}{
+		{Config{TopicPriorities: priorities, BroadcastLimit: 1}}, // cycle limit filled by priority
+		{Config{TopicPriorities: priorities, TopicBudget: 1}},    // topic budget spent by priority
+	}
+	for i, tt := range tests {
+		node := NewWithConfig(tt.config)
+		for _, envelope := range []*Envelope{bulk, control} {
+			if err := node.Send(envelope); err != nil {
+				t.Fatalf("test %d: failed to send envelope: %v", i, err)
+			}
+		}
+		// Ensure the first cycle only forwards the prioritized envelope
+		peer, broadcast := broadcastTestPeer(node)
+		sent, err := broadcast()
+		if err != nil {
+			t.Fatalf("test %d: broadcast failed: %v", i, err)
+		}
+		if len(sent) != 1 || sent[0] != control.Hash() {
+			t.Fatalf("test %d: transmission mismatch: have %x, want [%x]", i, sent, control.Hash())
+		}
+		// Ensure the lower priority envelope was deferred, not dropped
+		if peer.marked(bulk) {
+			t.Fatalf("test %d: deferred envelope marked as known", i)
+		}
+		if tt.config.TopicBudget > 0 {
+			peer.budgets[newTopicFromString("shared")].last = time.Now().Add(-time.Second)
+		}
+		if sent, err = broadcast(); err != nil {
+			t.Fatalf("test %d: second broadcast failed: %v", i, err)
+		}
+		if len(sent) != 1 || sent[0] != bulk.Hash() {
+			t.Fatalf("test %d: deferred transmission mismatch: have %x, want [%x]", i, sent, bulk.Hash())
+		}
+	}
+}
+
+func TestPeerTopicBudget(t *testing.T) {
+	node := NewWithConfig(Config{TopicBudget: 2})
+
+	// Flood the pool with a noisy topic, and add a single quiet envelope
+	for i := 0; i < 10; i++ {
+		if err := node.Send(newStoreTestEnvelope(-10*time.Second, fmt.Sprintf("noise %d", i), "noisy")); err != nil {
+			t.Fatalf("noisy envelope %d: failed to send: %v", i, err)
+		}
+	}
+	quiet := newStoreTestEnvelope(0, "quiet", "quiet")
+	if err := node.Send(quiet); err != nil {
+		t.Fatalf("failed to send quiet envelope: %v", err)
+	}
+	// Broadcast the pool to a simulated peer and ensure the flood was throttled
+	tester, tested := p2p.MsgPipe()
+	defer tester.Close()
+	peer := newPeer(node, p2p.NewPeer(discover.NodeID{}, "", nil), tested)
+
+	errc := make(chan error, 1)
+	go func() { errc <- peer.broadcast() }()
+
+	packet, err := tester.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read broadcast: %v", err)
+	}
+	var envelopes []*Envelope
+	if err := packet.Decode(&envelopes); err != nil {
+		t.Fatalf("failed to decode broadcast: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("broadcast failed: %v", err)
+	}
+	noisy, quieted := 0, false
+	for _, envelope := range envelopes {
+		if envelope.Hash() == quiet.Hash() {
+			quieted = true
+		} else {
+			noisy++
+		}
+	}
+	if !quieted {
+		t.Errorf("quiet envelope starved by the noisy topic")
+	}
+	if noisy != 2 {
+		t.Errorf("noisy envelope count mismatch: have %d, want %d", noisy, 2)
+	}
+	// Ensure the throttled envelopes are retained for later cycles
+	pending := 0
+	for _, envelope := range node.envelopes() {
+		if !peer.marked(envelope) {
+			pending++
+		}
+	}
+	if pending != 8 {
+		t.Errorf("pending envelope count mismatch: have %d, want %d", pending, 8)
+	}
+	// Ensure spent budgets are retained, but idle ones dropped on expiration
+	peer.budgets[newTopicFromString("quiet")].last = time.Now().Add(-time.Second)
+	peer.expire()
+	if _, ok := peer.budgets[newTopicFromString("noisy")]; !ok {
+		t.Errorf("spent budget dropped")
+	}
+	if _, ok := peer.budgets[newTopicFromString("quiet")]; ok {
+		t.Errorf("idle budget retained")
+	}
+}
+
+func TestPeerKnownOverflow(t *testing.T) {
+	peer := newPeer(New(), p2p.NewPeer(discover.NodeID{}, "", nil), nil)
+
+	// Fill up the exact known set and mark an envelope beyond it
+	for i := 0; i < knownExactLimit; i++ {
+		peer.known.Add(common.BytesToHash([]byte{byte(i >> 16), byte(i >> 8), byte(i)}))
+	}
+	envelope := newStoreTestEnvelope(-DefaultTTL-time.Minute, "overflow", "a")
+	peer.mark(envelope)
+
+	if peer.known.Size() != knownExactLimit {
+		t.Fatalf("exact known set grew past limit: have %d, want %d", peer.known.Size(), knownExactLimit)
+	}
+	if !peer.marked(envelope) {
+		t.Fatalf("overflowed envelope not marked")
+	}
+	// Expire the peer and ensure the stale overflow filter is dropped
+	peer.expire()
+	if peer.overflow != nil || peer.marked(envelope) {
+		t.Fatalf("expired overflow filter retained")
+	}
+}
+
+func TestPeerKnownOverflowRotation(t *testing.T) {
+	peer := newPeer(New(), p2p.NewPeer(discover.NodeID{}, "", nil), nil)
+	for i := 0; i < knownExactLimit; i++ {
+		peer.known.Add(common.BytesToHash([]byte{byte(i >> 16), byte(i >> 8), byte(i)}))
+	}
+	hash := func(prefix byte, i int) common.Hash {
+		return common.BytesToHash([]byte{prefix, byte(i >> 16), byte(i >> 8), byte(i)})
+	}
+	// Mark a sustained stream of live envelopes, well beyond the filter capacity
+	expiry, marks := uint32(time.Now().Add(DefaultTTL).Unix()), 3*knownBloomItems
+	for i := 0; i < marks; i++ {
+		peer.mark(&Envelope{Expiry: expiry, hash: hash(0x01, i)})
+	}
+	// Ensure recent envelopes are still known, but fresh ones are not
+	if !peer.marked(&Envelope{hash: hash(0x01, marks-1)}) {
+		t.Fatalf("recently marked envelope not known")
+	}
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if peer.marked(&Envelope{hash: hash(0x02, i)}) {
+			positives++
+		}
+	}
+	if positives > 100 {
+		t.Fatalf("fresh envelopes reported known: have %d/10000, want at most 100", positives)
+	}
+}
+
+func TestPeerSelfOriginatedDrop(t *testing.T) {
+	// Start a tester and execute the handshake
+	tester, err := startTestPeerInited()
+	if err != nil {
+		t.Fatalf("failed to start initialized peer: %v", err)
+	}
+	defer tester.stream.Close()
+
+	// Send a local message and loop it back through the peer
+	envelope, err := NewMessage([]byte("looped message")).Wrap(DefaultPoW, Options{})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if err := tester.client.Send(envelope); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	go func() {
+		for {
+			if err := p2p.ExpectMsg(tester.stream, messagesCode, nil); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := p2p.Send(tester.stream, messagesCode, []*Envelope{envelope}); err != nil {
+		t.Fatalf("failed to loop message back: %v", err)
+	}
+	// Wait for the looped back envelope to be dropped and counted
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if tester.client.Stats().SelfDrops == 1 {
+			return
+		}
+	}
+	t.Fatalf("self drop count mismatch: have %d, want %d", tester.client.Stats().SelfDrops, 1)
+}
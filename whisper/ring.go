@@ -0,0 +1,225 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains a consistent hashing ring assigning topics to relay nodes.
+
+package whisper
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/aiblocksproject/go-aiblocks/crypto"
+	"github.com/aiblocksproject/go-aiblocks/logger"
+	"github.com/aiblocksproject/go-aiblocks/logger/glog"
+	"github.com/aiblocksproject/go-aiblocks/p2p/discover"
+)
+
+// ringReplicas is the number of virtual nodes each relay is placed on the ring
+// with, smoothing out the share of topics assigned to each of them.
+const ringReplicas = 64
+
+// Ring is a consistent hashing ring assigning topics to relay nodes, such that
+// adding or removing a relay only reassigns the topics it gains or loses. Both
+// topics and (virtual) relays are positioned on the 32 bit ring, each topic being
+// owned by the first relay at or after its position.
+//
+// Ring is safe for concurrent use.
+type Ring struct {
+	points    []uint32                   // Sorted positions of the virtual nodes
+	owners    map[uint32]discover.NodeID // Relays owning each virtual node
+	listeners map[int]func()             // Callbacks to invoke on membership changes
+	listenId  int                        // Id to assign to the next callback
+	lock      sync.RWMutex
+}
+
+// NewRing creates an empty consistent hashing ring.
+func NewRing() *Ring {
+	return &Ring{
+		owners:    make(map[uint32]discover.NodeID),
+		listeners: make(map[int]func()),
+	}
+}
+
+// Add places a relay node onto the ring. Adding an already present node is a
+// no-op.
+func (self *Ring) Add(node discover.NodeID) {
+	defer self.notify()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i := 0; i < ringReplicas; i++ {
+		point := ringPoint(node, i)
+		if _, ok := self.owners[point]; ok {
+			continue // Already present, or (very unlikely) colliding
+		}
+		self.owners[point] = node
+		self.points = append(self.points, point)
+	}
+	sort.Sort(uint32Slice(self.points))
+}
+
+// Remove drops a relay node from the ring, reassigning its topics to the nodes
+// following it.
+func (self *Ring) Remove(node discover.NodeID) {
+	defer self.notify()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	points := self.points[:0]
+	for _, point := range self.points {
+		if self.owners[point] == node {
+			delete(self.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	self.points = points
+}
+
+// Owner retrieves the relay node a topic is assigned to. The boolean is false if
+// the ring is empty.
+func (self *Ring) Owner(topic Topic) (discover.NodeID, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	if len(self.points) == 0 {
+		return discover.NodeID{}, false
+	}
+	position := topic.Uint32()
+	index := sort.Search(len(self.points), func(i int) bool { return self.points[i] >= position })
+	if index == len(self.points) {
+		index = 0
+	}
+	return self.owners[self.points[index]], true
+}
+
+// OnChange registers a callback to invoke after every membership change of the
+// ring. Callbacks run synchronously, outside of the ring's lock. The returned
+// function unregisters the callback.
+func (self *Ring) OnChange(fn func()) func() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	id := self.listenId
+	self.listenId++
+	self.listeners[id] = fn
+
+	return func() {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		delete(self.listeners, id)
+	}
+}
+
+// notify invokes the membership change callbacks.
+func (self *Ring) notify() {
+	self.lock.RLock()
+	listeners := make([]func(), 0, len(self.listeners))
+	for _, fn := range self.listeners {
+		listeners = append(listeners, fn)
+	}
+	self.lock.RUnlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+// WatchShard installs a message handler for the candidate topics that the ring
+// currently assigns to the local relay, and keeps it in sync as the ring
+// membership changes: topics reassigned to other relays are shed, and those
+// gained are picked up. Topics must be tracked as an explicit candidate list, as
+// the ring cannot enumerate the topics falling within a range. The handler is
+// matched on the first topic of the messages, the rest of the options applying
+// as with Watch. The returned function stops following the ring and removes the
+// handler.
+func (self *Whisper) WatchShard(ring *Ring, local discover.NodeID, topics []Topic, options Filter) func() {
+	var (
+		id        = -1 // Id of the installed filter, negative if none
+		installed []Topic
+		stopped   bool
+		lock      sync.Mutex
+	)
+	refresh := func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if stopped {
+			return
+		}
+		var owned []Topic
+		for _, topic := range topics {
+			if owner, ok := ring.Owner(topic); ok && owner == local {
+				owned = append(owned, topic)
+			}
+		}
+		if id >= 0 && reflect.DeepEqual(owned, installed) {
+			return
+		}
+		// Swap the handler over to the new shard atomically, so topics served both
+		// before and after miss no messages. An empty shard installs no handler, as
+		// an empty condition would match everything.
+		installed = owned
+		switch {
+		case id >= 0 && len(owned) == 0:
+			self.Unwatch(id)
+			id = -1
+		case id >= 0:
+			if err := self.retopic(id, [][]Topic{owned}, false); err != nil {
+				glog.V(logger.Debug).Infof("failed to reshard filter %d: %v", id, err)
+			}
+		case len(owned) > 0:
+			shard := options
+			shard.Topics = [][]Topic{owned}
+			id = self.Watch(shard)
+		}
+	}
+	unsubscribe := ring.OnChange(refresh)
+	refresh()
+
+	return func() {
+		unsubscribe()
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		stopped = true
+		if id >= 0 {
+			self.Unwatch(id)
+			id = -1
+		}
+	}
+}
+
+// ringPoint calculates the ring position of a relay's virtual node.
+func ringPoint(node discover.NodeID, replica int) uint32 {
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], uint32(replica))
+	return binary.BigEndian.Uint32(crypto.Keccak256(node[:], index[:])[:4])
+}
+
+// uint32Slice implements sort.Interface for a slice of ring positions.
+type uint32Slice []uint32
+
+func (self uint32Slice) Len() int           { return len(self) }
+func (self uint32Slice) Less(i, j int) bool { return self[i] < self[j] }
+func (self uint32Slice) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
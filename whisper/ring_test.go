@@ -0,0 +1,134 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisper
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aiblocksproject/go-aiblocks/p2p/discover"
+)
+
+func TestWatchShard(t *testing.T) {
+	node := New()
+
+	// Create a ring with the local relay only, owning all the topics
+	local, remote := discover.NodeID{1}, discover.NodeID{2}
+	ring := NewRing()
+	ring.Add(local)
+
+	topics := make([]Topic, 100)
+	for i := range topics {
+		topics[i] = NewTopic([]byte(fmt.Sprintf("shard %d", i)))
+	}
+	stop := node.WatchShard(ring, local, topics, Filter{Fn: func(*Message) {}})
+
+	served := func() map[Topic]bool {
+		served := make(map[Topic]bool)
+		node.statsMu.Lock()
+		defer node.statsMu.Unlock()
+
+		for id := range node.matchers {
+			for _, topic := range node.filters.Get(id).(filterer).matcher.AllTopics() {
+				served[topic] = true
+			}
+		}
+		return served
+	}
+	if have := len(served()); have != len(topics) {
+		t.Fatalf("served topic count mismatch: have %d, want %d", have, len(topics))
+	}
+	// Add a remote relay and ensure the local one sheds exactly the reassigned topics
+	ring.Add(remote)
+
+	shed, kept := 0, 0
+	current := served()
+	for _, topic := range topics {
+		owner, _ := ring.Owner(topic)
+		switch {
+		case owner == local && !current[topic]:
+			t.Fatalf("topic %x: still owned but no longer served", topic)
+		case owner == remote && current[topic]:
+			t.Fatalf("topic %x: reassigned but still served", topic)
+		case owner == remote:
+			shed++
+		default:
+			kept++
+		}
+	}
+	if shed == 0 || kept == 0 {
+		t.Fatalf("unbalanced reassignment: shed %d, kept %d", shed, kept)
+	}
+	// Stop following the ring and ensure the handler is removed
+	stop()
+	if installed := node.Stats().Matchers; installed != 0 {
+		t.Fatalf("installed handler count mismatch: have %d, want %d", installed, 0)
+	}
+	// Ensure further ring changes no longer reach the stopped watch
+	if listeners := len(ring.listeners); listeners != 0 {
+		t.Fatalf("ring listener count mismatch: have %d, want %d", listeners, 0)
+	}
+	ring.Remove(remote)
+	if installed := node.Stats().Matchers; installed != 0 {
+		t.Fatalf("installed handler count mismatch after ring change: have %d, want %d", installed, 0)
+	}
+}
+
+func TestRingReassignment(t *testing.T) {
+	ring := NewRing()
+	if _, ok := ring.Owner(NewTopic([]byte("orphan"))); ok {
+		t.Fatalf("empty ring assigned an owner")
+	}
+	// Assign a batch of topics to a few relays
+	nodes := make([]discover.NodeID, 5)
+	for i := range nodes {
+		nodes[i][0] = byte(i + 1)
+	}
+	for _, node := range nodes[:4] {
+		ring.Add(node)
+	}
+	topics := make([]Topic, 1000)
+	before := make([]discover.NodeID, len(topics))
+	for i := range topics {
+		topics[i] = NewTopic([]byte(fmt.Sprintf("topic %d", i)))
+		before[i], _ = ring.Owner(topics[i])
+	}
+	// Add a new relay and ensure only topics moving onto it are reassigned
+	ring.Add(nodes[4])
+
+	moved := 0
+	for i, topic := range topics {
+		owner, _ := ring.Owner(topic)
+		if owner != before[i] {
+			if owner != nodes[4] {
+				t.Fatalf("topic %d: reassigned between old relays: %x -> %x", i, before[i][:1], owner[:1])
+			}
+			moved++
+		}
+	}
+	// Expect about a fifth to move, allowing plenty of slack for the hashing
+	if moved == 0 || moved > len(topics)/2 {
+		t.Fatalf("reassigned topic count out of bounds: have %d of %d", moved, len(topics))
+	}
+	// Remove the relay again and ensure the original assignment is restored
+	ring.Remove(nodes[4])
+	for i, topic := range topics {
+		if owner, _ := ring.Owner(topic); owner != before[i] {
+			t.Fatalf("topic %d: owner mismatch after removal: have %x, want %x", i, owner[:1], before[i][:1])
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the retention bookkeeping of the locally stored whisper envelopes.
+
+package whisper
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aiblocksproject/go-aiblocks/common"
+	"github.com/aiblocksproject/go-aiblocks/rlp"
+)
+
+// Store is the retention backend of the whisper message store. The node puts all
+// newly pooled envelopes into it, prunes it periodically and serves historical
+// queries out of it. Implementations must be safe for concurrent use.
+type Store interface {
+	// Put inserts an envelope into the store, assigning it the next value of the
+	// store's monotonically increasing arrival sequence (see Seq). Storing an
+	// already known envelope must not be considered an error, and must retain
+	// its original sequence number.
+	Put(envelope *Envelope) error
+
+	// Seq retrieves the arrival sequence number assigned to a stored envelope, or
+	// zero if the envelope is not stored. Paginated and resumed queries follow
+	// this order, so envelopes arriving late with an earlier send time (e.g. due
+	// to clock skew or relay delays) are still served after a checkpoint.
+	Seq(hash common.Hash) uint64
+
+	// Get retrieves all the stored envelopes tagged with any of the specified
+	// topics (or all if none given), sent within the [from, to] interval. Zero
+	// times leave the corresponding side of the interval unbounded.
+	Get(topics []Topic, from, to time.Time) []*Envelope
+
+	// Prune drops all the envelopes that have expired by the given time.
+	Prune(now time.Time)
+
+	// Stats retrieves the per topic retention statistics of the store.
+	Stats() map[Topic]StoreTopicStat
+}
+
+// StoreTopicStat contains the retention statistics of a single topic within the
+// local message store.
+type StoreTopicStat struct {
+	Envelopes int                // Number of stored envelopes tagged with the topic
+	Size      common.StorageSize // Total RLP encoded size of the stored envelopes
+	Oldest    time.Time          // Send time of the oldest stored envelope
+	Newest    time.Time          // Send time of the newest stored envelope
+}
+
+// StoreCursor marks a position in the arrival ordered message store, allowing a
+// paginated query to continue right after the last envelope of a page. The zero
+// cursor denotes the start of the store.
+type StoreCursor struct {
+	Seq uint64 // Arrival sequence number of the last envelope served
+}
+
+// IsZero checks whether the cursor denotes the start of the store.
+func (self StoreCursor) IsZero() bool {
+	return self == StoreCursor{}
+}
+
+// envelopesBySeq implements sort.Interface, ordering envelopes by their arrival
+// sequence numbers.
+type envelopesBySeq struct {
+	envelopes []*Envelope
+	seqs      []uint64
+}
+
+func (self *envelopesBySeq) Len() int           { return len(self.envelopes) }
+func (self *envelopesBySeq) Less(i, j int) bool { return self.seqs[i] < self.seqs[j] }
+func (self *envelopesBySeq) Swap(i, j int) {
+	self.envelopes[i], self.envelopes[j] = self.envelopes[j], self.envelopes[i]
+	self.seqs[i], self.seqs[j] = self.seqs[j], self.seqs[i]
+}
+
+// storePage orders a batch of envelopes retrieved from a store by their arrival,
+// and retrieves at most limit of them positioned after the cursor (all if limit
+// is not positive), along with the cursor to continue from. The returned cursor
+// is zero if no envelopes remain. Envelopes no longer stored are skipped.
+func storePage(store Store, envelopes []*Envelope, limit int, cursor StoreCursor) ([]*Envelope, StoreCursor) {
+	batch := &envelopesBySeq{
+		envelopes: make([]*Envelope, 0, len(envelopes)),
+		seqs:      make([]uint64, 0, len(envelopes)),
+	}
+	for _, envelope := range envelopes {
+		if seq := store.Seq(envelope.Hash()); seq > cursor.Seq {
+			batch.envelopes = append(batch.envelopes, envelope)
+			batch.seqs = append(batch.seqs, seq)
+		}
+	}
+	sort.Sort(batch)
+
+	if limit <= 0 || len(batch.envelopes) <= limit {
+		return batch.envelopes, StoreCursor{}
+	}
+	return batch.envelopes[:limit], StoreCursor{Seq: batch.seqs[limit-1]}
+}
+
+// TopicCount is a single entry of a topic frequency histogram.
+type TopicCount struct {
+	Topic     Topic // Topic the entry is about
+	Envelopes int   // Number of stored envelopes tagged with the topic
+}
+
+// topicHistogram flattens per topic retention statistics into a histogram of the
+// at most limit most frequent topics (all if limit is not positive), ordered by
+// descending frequency. Equally frequent topics are ordered by their value.
+func topicHistogram(stats map[Topic]StoreTopicStat, limit int) []TopicCount {
+	histogram := make([]TopicCount, 0, len(stats))
+	for topic, stat := range stats {
+		histogram = append(histogram, TopicCount{Topic: topic, Envelopes: stat.Envelopes})
+	}
+	sort.Sort(topicCountsByFrequency(histogram))
+
+	if limit > 0 && len(histogram) > limit {
+		histogram = histogram[:limit]
+	}
+	return histogram
+}
+
+// topicCountsByFrequency implements sort.Interface, ordering histogram entries
+// by descending frequency, breaking ties by topic.
+type topicCountsByFrequency []TopicCount
+
+func (self topicCountsByFrequency) Len() int      { return len(self) }
+func (self topicCountsByFrequency) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self topicCountsByFrequency) Less(i, j int) bool {
+	if self[i].Envelopes != self[j].Envelopes {
+		return self[i].Envelopes > self[j].Envelopes
+	}
+	return bytes.Compare(self[i].Topic[:], self[j].Topic[:]) < 0
+}
+
+// add accounts an additional envelope into the topic statistics.
+func (self *StoreTopicStat) add(envelope *Envelope) {
+	size, _ := rlp.EncodeToBytes(envelope)
+	sent := time.Unix(int64(envelope.Expiry-envelope.TTL), 0)
+
+	if self.Envelopes == 0 || sent.Before(self.Oldest) {
+		self.Oldest = sent
+	}
+	if self.Envelopes == 0 || sent.After(self.Newest) {
+		self.Newest = sent
+	}
+	self.Envelopes++
+	self.Size += common.StorageSize(len(size))
+}
+
+// storeStats aggregates the per topic retention statistics of a batch of
+// envelopes. Envelopes tagged with the same topic multiple times are accounted
+// only once for that topic.
+func storeStats(envelopes map[common.Hash]*Envelope) map[Topic]StoreTopicStat {
+	stats := make(map[Topic]StoreTopicStat)
+	for _, envelope := range envelopes {
+		seen := make(map[Topic]struct{}, len(envelope.Topics))
+		for _, topic := range envelope.Topics {
+			if _, ok := seen[topic]; ok {
+				continue
+			}
+			seen[topic] = struct{}{}
+
+			stat := stats[topic]
+			stat.add(envelope)
+			stats[topic] = stat
+		}
+	}
+	return stats
+}
+
+// memoryStore is the built-in Store implementation, retaining envelopes in
+// memory until they expire.
+type memoryStore struct {
+	envelopes map[common.Hash]*Envelope
+	seqs      map[common.Hash]uint64 // Arrival sequence numbers of the stored envelopes
+	seq       uint64                 // Last assigned arrival sequence number
+	lock      sync.RWMutex
+}
+
+// newMemoryStore creates an empty in-memory envelope store.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		envelopes: make(map[common.Hash]*Envelope),
+		seqs:      make(map[common.Hash]uint64),
+	}
+}
+
+// Put implements Store, inserting an envelope into the store.
+func (self *memoryStore) Put(envelope *Envelope) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	hash := envelope.Hash()
+	if _, ok := self.envelopes[hash]; ok {
+		return nil
+	}
+	self.seq++
+	self.envelopes[hash], self.seqs[hash] = envelope, self.seq
+	return nil
+}
+
+// Seq implements Store, retrieving the arrival sequence number of an envelope.
+func (self *memoryStore) Seq(hash common.Hash) uint64 {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	return self.seqs[hash]
+}
+
+// Get implements Store, retrieving the envelopes matching the requested topics
+// and send time interval.
+func (self *memoryStore) Get(topics []Topic, from, to time.Time) []*Envelope {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	envelopes := make([]*Envelope, 0)
+	for _, envelope := range self.envelopes {
+		if storeMatches(envelope, topics, from, to) {
+			envelopes = append(envelopes, envelope)
+		}
+	}
+	return envelopes
+}
+
+// Prune implements Store, dropping all the envelopes expired by now.
+func (self *memoryStore) Prune(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for hash, envelope := range self.envelopes {
+		if int64(envelope.Expiry) < now.Unix() {
+			delete(self.envelopes, hash)
+			delete(self.seqs, hash)
+		}
+	}
+}
+
+// Stats implements Store, retrieving the per topic retention statistics.
+func (self *memoryStore) Stats() map[Topic]StoreTopicStat {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	return storeStats(self.envelopes)
+}
+
+// storeMatches checks whether an envelope satisfies a store query, namely if
+// it is tagged with any of the requested topics (or no topics were requested)
+// and was sent within the [from, to] interval.
+func storeMatches(envelope *Envelope, topics []Topic, from, to time.Time) bool {
+	sent := time.Unix(int64(envelope.Expiry-envelope.TTL), 0)
+	if !from.IsZero() && sent.Before(from) {
+		return false
+	}
+	if !to.IsZero() && sent.After(to) {
+		return false
+	}
+	if len(topics) == 0 {
+		return true
+	}
+	for _, want := range topics {
+		for _, topic := range envelope.Topics {
+			if topic == want {
+				return true
+			}
+		}
+	}
+	return false
+}
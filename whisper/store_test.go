@@ -0,0 +1,453 @@
+// Copyright 2016 The go-aiblocks Authors
+// This file is part of the go-aiblocks library.
+//
+// The go-aiblocks library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-aiblocks library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-aiblocks library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisper
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aiblocksproject/go-aiblocks/common"
+	"github.com/aiblocksproject/go-aiblocks/rlp"
+)
+
+// newStoreTestEnvelope creates an envelope with the given topics, sent at the
+// specified offset from now.
+func newStoreTestEnvelope(offset time.Duration, payload string, topics ...string) *Envelope {
+	sent := time.Now().Add(offset)
+	return &Envelope{
+		Expiry: uint32(sent.Add(DefaultTTL).Unix()),
+		TTL:    uint32(DefaultTTL.Seconds()),
+		Topics: newTopicsFromStrings(topics...),
+		Data:   append([]byte{0x00}, payload...),
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	node := New()
+
+	envelopes := []*Envelope{
+		newStoreTestEnvelope(-3*time.Second, "first", "a"),
+		newStoreTestEnvelope(-2*time.Second, "second", "a", "b"),
+		newStoreTestEnvelope(-1*time.Second, "third", "b", "b"),
+		newStoreTestEnvelope(0, "fourth", "c"),
+	}
+	for i, envelope := range envelopes {
+		if err := node.add(envelope); err != nil {
+			t.Fatalf("envelope %d: failed to add: %v", i, err)
+		}
+	}
+	size := func(envelopes ...*Envelope) common.StorageSize {
+		total := 0
+		for _, envelope := range envelopes {
+			enc, _ := rlp.EncodeToBytes(envelope)
+			total += len(enc)
+		}
+		return common.StorageSize(total)
+	}
+	sent := func(envelope *Envelope) time.Time {
+		return time.Unix(int64(envelope.Expiry-envelope.TTL), 0)
+	}
+	want := map[Topic]StoreTopicStat{
+		newTopicFromString("a"): {2, size(envelopes[0], envelopes[1]), sent(envelopes[0]), sent(envelopes[1])},
+		newTopicFromString("b"): {2, size(envelopes[1], envelopes[2]), sent(envelopes[1]), sent(envelopes[2])},
+		newTopicFromString("c"): {1, size(envelopes[3]), sent(envelopes[3]), sent(envelopes[3])},
+	}
+	stats := node.StoreStats()
+	if len(stats) != len(want) {
+		t.Fatalf("topic count mismatch: have %d, want %d", len(stats), len(want))
+	}
+	for topic, stat := range want {
+		if have := stats[topic]; have != stat {
+			t.Errorf("topic %x: stat mismatch: have %+v, want %+v", topic, have, stat)
+		}
+	}
+}
+
+// mockStore is a Store implementation recording the calls made into it.
+type mockStore struct {
+	puts   []*Envelope
+	gets   int
+	prunes int
+	lock   sync.Mutex
+}
+
+func (self *mockStore) Put(envelope *Envelope) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.puts = append(self.puts, envelope)
+	return nil
+}
+
+func (self *mockStore) Seq(hash common.Hash) uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i, envelope := range self.puts {
+		if envelope.Hash() == hash {
+			return uint64(i + 1)
+		}
+	}
+	return 0
+}
+
+func (self *mockStore) Get(topics []Topic, from, to time.Time) []*Envelope {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.gets++
+	return self.puts
+}
+
+func (self *mockStore) Prune(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.prunes++
+}
+
+func (self *mockStore) Stats() map[Topic]StoreTopicStat {
+	return nil
+}
+
+func TestEstimateSubscriptionBandwidth(t *testing.T) {
+	node := New()
+
+	// Seed the store with traffic within and beyond the estimation window
+	var inside []*Envelope
+	for i := 0; i < 5; i++ {
+		envelope := newStoreTestEnvelope(-time.Duration(i)*time.Second, fmt.Sprintf("inside %d", i), "a", "b")
+		inside = append(inside, envelope)
+		node.store.Put(envelope)
+	}
+	node.store.Put(newStoreTestEnvelope(-30*time.Second, "outside", "a", "b"))
+	node.store.Put(newStoreTestEnvelope(0, "unrelated", "c"))
+
+	// Ensure the estimate matches the analytic expectation of the window's traffic
+	size := 0
+	for _, envelope := range inside {
+		enc, _ := rlp.EncodeToBytes(envelope)
+		size += len(enc)
+	}
+	want := float64(size) / 10
+	have := node.EstimateSubscriptionBandwidth(newFilterTopicsFromStrings([]string{"a"}), 10*time.Second)
+	if math.Abs(have-want) > 1e-9 {
+		t.Fatalf("bandwidth estimate mismatch: have %f, want %f", have, want)
+	}
+	if have := node.EstimateSubscriptionBandwidth(newFilterTopicsFromStrings([]string{"d"}), 10*time.Second); have != 0 {
+		t.Fatalf("unmatched bandwidth estimate mismatch: have %f, want 0", have)
+	}
+}
+
+func TestEstimateEphemeralBandwidth(t *testing.T) {
+	node := NewWithConfig(Config{EphemeralTopics: newTopicsFromStrings("presence")})
+
+	// Send ephemeral traffic, never retained by the message store
+	size := 0
+	for i := 0; i < 3; i++ {
+		envelope := newStoreTestEnvelope(-time.Duration(i)*time.Second, fmt.Sprintf("ping %d", i), "presence")
+		if err := node.add(envelope); err != nil {
+			t.Fatalf("envelope %d: failed to add: %v", i, err)
+		}
+		enc, _ := rlp.EncodeToBytes(envelope)
+		size += len(enc)
+	}
+	// Ensure both the estimate and the histogram account for it
+	want := float64(size) / 10
+	if have := node.EstimateSubscriptionBandwidth(newFilterTopicsFromStrings([]string{"presence"}), 10*time.Second); math.Abs(have-want) > 1e-9 {
+		t.Fatalf("bandwidth estimate mismatch: have %f, want %f", have, want)
+	}
+	histogram := node.TopicHistogram(0)
+	if len(histogram) != 1 || histogram[0] != (TopicCount{newTopicFromString("presence"), 3}) {
+		t.Fatalf("histogram mismatch: have %+v, want presence x3", histogram)
+	}
+}
+
+func TestTopicHistogram(t *testing.T) {
+	node := New()
+
+	// Send traffic with a known topic distribution
+	counts := map[string]int{"a": 2, "b": 5, "c": 1, "d": 3}
+	for topic, count := range counts {
+		for i := 0; i < count; i++ {
+			if err := node.add(newStoreTestEnvelope(-time.Duration(i)*time.Second, topic, topic)); err != nil {
+				t.Fatalf("topic %s, envelope %d: failed to add: %v", topic, i, err)
+			}
+		}
+	}
+	// Ensure the histogram reports the most frequent topics in order
+	histogram := node.TopicHistogram(3)
+	want := []TopicCount{
+		{newTopicFromString("b"), 5},
+		{newTopicFromString("d"), 3},
+		{newTopicFromString("a"), 2},
+	}
+	if len(histogram) != len(want) {
+		t.Fatalf("histogram length mismatch: have %d, want %d", len(histogram), len(want))
+	}
+	for i := range want {
+		if histogram[i] != want[i] {
+			t.Errorf("entry %d: mismatch: have %+v, want %+v", i, histogram[i], want[i])
+		}
+	}
+	if all := node.TopicHistogram(0); len(all) != len(counts) {
+		t.Errorf("unbounded histogram length mismatch: have %d, want %d", len(all), len(counts))
+	}
+}
+
+func TestTailStore(t *testing.T) {
+	node := New()
+
+	// Tail a topic, and store both matching and unrelated envelopes
+	stream, cancel := node.TailStore(newTopicsFromStrings("a"))
+	defer cancel()
+
+	matching := newStoreTestEnvelope(0, "matching", "a", "b")
+	for _, envelope := range []*Envelope{newStoreTestEnvelope(0, "unrelated", "c"), matching} {
+		if err := node.add(envelope); err != nil {
+			t.Fatalf("failed to add envelope: %v", err)
+		}
+	}
+	select {
+	case envelope := <-stream:
+		if envelope != matching {
+			t.Fatalf("tailed envelope mismatch: have %x, want %x", envelope.Hash(), matching.Hash())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("tailed envelope timeout")
+	}
+	// Cancel the tail and ensure the stream is closed
+	cancel()
+	if _, ok := <-stream; ok {
+		t.Fatalf("stream not closed after cancellation")
+	}
+}
+
+func TestTailStoreLagging(t *testing.T) {
+	node := New()
+
+	stream, cancel := node.TailStore(nil)
+	defer cancel()
+
+	var tail *storeTail
+	for tail = range node.tails {
+	}
+	// Store an envelope and wait for it to be taken out of the buffer for delivery
+	first := newStoreTestEnvelope(0, "first", "a")
+	if err := node.add(first); err != nil {
+		t.Fatalf("failed to add envelope: %v", err)
+	}
+	for start := time.Now(); tail.buffer.Len() > 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	// Overflow the buffer without consuming and ensure the oldest ones are dropped
+	envelopes := make([]*Envelope, storeTailBuffer+5)
+	for i := range envelopes {
+		envelopes[i] = newStoreTestEnvelope(0, fmt.Sprintf("lagging %d", i), "a")
+		if err := node.add(envelopes[i]); err != nil {
+			t.Fatalf("envelope %d: failed to add: %v", i, err)
+		}
+	}
+	if drops := node.Stats().TailDrops; drops != 5 {
+		t.Fatalf("dropped envelope count mismatch: have %d, want %d", drops, 5)
+	}
+	for i, want := range append([]*Envelope{first}, envelopes[5:]...) {
+		select {
+		case envelope := <-stream:
+			if envelope != want {
+				t.Fatalf("envelope %d: tailed envelope mismatch: have %x, want %x", i, envelope.Hash(), want.Hash())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("envelope %d: tailed envelope timeout", i)
+		}
+	}
+}
+
+func TestEphemeralTopics(t *testing.T) {
+	node := NewWithConfig(Config{EphemeralTopics: newTopicsFromStrings("presence")})
+
+	// Send an ephemeral envelope and ensure it's delivered live
+	delivered := make(chan *Message, 1)
+	node.Watch(Filter{
+		Topics: newFilterTopicsFromStringsFlat("presence"),
+		Fn:     func(msg *Message) { delivered <- msg },
+	})
+	if err := node.Send(newStoreTestEnvelope(0, "online", "presence")); err != nil {
+		t.Fatalf("failed to send envelope: %v", err)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatalf("ephemeral envelope not delivered")
+	}
+	// Ensure it's absent from the store, unlike durable ones
+	if err := node.Send(newStoreTestEnvelope(0, "durable", "chat")); err != nil {
+		t.Fatalf("failed to send envelope: %v", err)
+	}
+	if stored := node.QueryStore(nil, time.Time{}, time.Time{}); len(stored) != 1 || string(stored[0].Data[1:]) != "durable" {
+		t.Fatalf("stored envelopes mismatch: have %d, want only the durable one", len(stored))
+	}
+}
+
+func TestStoreBackend(t *testing.T) {
+	store := new(mockStore)
+	node := NewWithConfig(Config{Store: store})
+
+	// Send a message twice and ensure it's stored only once
+	envelope := newStoreTestEnvelope(0, "stored", "a")
+	for i := 0; i < 2; i++ {
+		if err := node.Send(envelope); err != nil {
+			t.Fatalf("send %d: failed to send envelope: %v", i, err)
+		}
+	}
+	if len(store.puts) != 1 || store.puts[0] != envelope {
+		t.Fatalf("stored envelopes mismatch: have %v, want %v", store.puts, []*Envelope{envelope})
+	}
+	// Query the node and ensure it's served from the backend
+	if stored := node.QueryStore(newTopicsFromStrings("a"), time.Time{}, time.Time{}); len(stored) != 1 {
+		t.Fatalf("queried envelopes mismatch: have %d, want %d", len(stored), 1)
+	}
+	if store.gets != 1 {
+		t.Fatalf("store query count mismatch: have %d, want %d", store.gets, 1)
+	}
+	// Run an expiration cycle and ensure the backend is pruned
+	node.expire()
+	if store.prunes != 1 {
+		t.Fatalf("store prune count mismatch: have %d, want %d", store.prunes, 1)
+	}
+}
+
+func TestStorePagination(t *testing.T) {
+	node := New()
+
+	// Store a batch of envelopes, some sharing the same send second
+	for i := 0; i < 25; i++ {
+		envelope := newStoreTestEnvelope(-time.Duration(i/2)*time.Second, fmt.Sprintf("page %d", i), "a")
+		if err := node.add(envelope); err != nil {
+			t.Fatalf("envelope %d: failed to add: %v", i, err)
+		}
+	}
+	// Page through the store and ensure all envelopes are served exactly once
+	var (
+		cursor StoreCursor
+		pages  int
+		seen   = make(map[common.Hash]struct{})
+		last   uint64
+	)
+	for {
+		page, next := node.QueryStorePage(newTopicsFromStrings("a"), time.Time{}, time.Time{}, 10, cursor)
+		if len(page) > 10 {
+			t.Fatalf("page %d: size mismatch: have %d, want at most %d", pages, len(page), 10)
+		}
+		for _, envelope := range page {
+			if _, dup := seen[envelope.Hash()]; dup {
+				t.Fatalf("page %d: duplicate envelope %x", pages, envelope.Hash())
+			}
+			seen[envelope.Hash()] = struct{}{}
+
+			if seq := node.store.Seq(envelope.Hash()); seq <= last {
+				t.Fatalf("page %d: envelope %x out of arrival order", pages, envelope.Hash())
+			}
+			last = node.store.Seq(envelope.Hash())
+		}
+		pages++
+		if next.IsZero() {
+			break
+		}
+		cursor = next
+	}
+	if pages != 3 {
+		t.Errorf("page count mismatch: have %d, want %d", pages, 3)
+	}
+	if len(seen) != 25 {
+		t.Errorf("served envelope count mismatch: have %d, want %d", len(seen), 25)
+	}
+}
+
+func TestStorePaginationBackdated(t *testing.T) {
+	node := New()
+
+	for i := 0; i < 3; i++ {
+		if err := node.add(newStoreTestEnvelope(-time.Duration(3-i)*time.Second, fmt.Sprintf("live %d", i), "a")); err != nil {
+			t.Fatalf("envelope %d: failed to add: %v", i, err)
+		}
+	}
+	page, cursor := node.QueryStorePage(nil, time.Time{}, time.Time{}, 2, StoreCursor{})
+	if len(page) != 2 || cursor.IsZero() {
+		t.Fatalf("first page mismatch: have %d envelopes, cursor %v", len(page), cursor)
+	}
+	// Insert an envelope sent before all the others, arriving late (e.g. relayed
+	// slowly or sent with a skewed clock), and ensure it is served after the cursor
+	backdated := newStoreTestEnvelope(-30*time.Second, "backdated", "a")
+	if err := node.add(backdated); err != nil {
+		t.Fatalf("failed to add backdated envelope: %v", err)
+	}
+	page, cursor = node.QueryStorePage(nil, time.Time{}, time.Time{}, 2, cursor)
+	if len(page) != 2 || !cursor.IsZero() {
+		t.Fatalf("second page mismatch: have %d envelopes, cursor %v", len(page), cursor)
+	}
+	if page[1].Hash() != backdated.Hash() {
+		t.Fatalf("backdated envelope not served after the cursor")
+	}
+}
+
+func TestMemoryStoreQuery(t *testing.T) {
+	store := newMemoryStore()
+
+	envelopes := []*Envelope{
+		newStoreTestEnvelope(-2*time.Minute, "first", "a"),
+		newStoreTestEnvelope(-time.Minute, "second", "b"),
+		newStoreTestEnvelope(0, "third", "a", "c"),
+	}
+	for _, envelope := range envelopes {
+		store.Put(envelope)
+	}
+	tests := []struct {
+		topics []string
+		from   time.Duration
+		to     time.Duration
+		count  int
+	}{
+		{count: 3},
+		{topics: []string{"a"}, count: 2},
+		{topics: []string{"b", "c"}, count: 2},
+		{topics: []string{"d"}, count: 0},
+		{from: -90 * time.Second, count: 2},
+		{to: -90 * time.Second, count: 1},
+		{topics: []string{"a"}, from: -90 * time.Second, to: -30 * time.Second, count: 0},
+	}
+	for i, tt := range tests {
+		var from, to time.Time
+		if tt.from != 0 {
+			from = time.Now().Add(tt.from)
+		}
+		if tt.to != 0 {
+			to = time.Now().Add(tt.to)
+		}
+		if have := store.Get(newTopicsFromStrings(tt.topics...), from, to); len(have) != tt.count {
+			t.Errorf("test %d: result count mismatch: have %d, want %d", i, len(have), tt.count)
+		}
+	}
+	// Prune the store past the expiration of the oldest envelope
+	store.Prune(time.Unix(int64(envelopes[0].Expiry)+1, 0))
+	if have := store.Get(nil, time.Time{}, time.Time{}); len(have) != 2 {
+		t.Fatalf("pruned result count mismatch: have %d, want %d", len(have), 2)
+	}
+}
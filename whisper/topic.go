@@ -19,37 +19,294 @@
 
 package whisper
 
-import "github.com/aiblocksproject/go-aiblocks/crypto"
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/aiblocksproject/go-aiblocks/common"
+	"github.com/aiblocksproject/go-aiblocks/crypto"
+	"github.com/aiblocksproject/go-aiblocks/crypto/sha3"
+)
 
 // Topic represents a cryptographically secure, probabilistic partial
 // classifications of a message, determined as the first (left) 4 bytes of the
 // SHA3 hash of some arbitrary data given by the original author of the message.
 type Topic [4]byte
 
+// topicHasher is a reusable Keccak256 hasher state along with a digest buffer
+// to avoid allocating a fresh output slice for every topic.
+type topicHasher struct {
+	hash   hash.Hash
+	digest []byte
+}
+
+// topicHasherPool caches hasher states across topic constructions. Each state
+// is owned by a single goroutine between Get and Put, so NewTopic remains safe
+// for concurrent use.
+var topicHasherPool = sync.Pool{
+	New: func() interface{} {
+		return &topicHasher{
+			hash:   sha3.NewKeccak256(),
+			digest: make([]byte, 0, 32),
+		}
+	},
+}
+
 // NewTopic creates a topic from the 4 byte prefix of the SHA3 hash of the data.
 //
 // Note, empty topics are considered the wildcard, and cannot be used in messages.
 func NewTopic(data []byte) Topic {
+	return newSaltedTopic(nil, data)
+}
+
+// newSaltedTopic creates a topic from the 4 byte prefix of the SHA3 hash of the
+// salt and data concatenated, without copying either of them.
+func newSaltedTopic(salt []byte, data []byte) Topic {
+	hasher := topicHasherPool.Get().(*topicHasher)
+	defer topicHasherPool.Put(hasher)
+
+	hasher.hash.Reset()
+	hasher.hash.Write(salt)
+	hasher.hash.Write(data)
+	hasher.digest = hasher.hash.Sum(hasher.digest[:0])
+
 	prefix := [4]byte{}
-	copy(prefix[:], crypto.Keccak256(data)[:4])
+	copy(prefix[:], hasher.digest[:4])
 	return Topic(prefix)
 }
 
 // NewTopics creates a list of topics from a list of binary data elements, by
 // iteratively calling NewTopic on each of them.
 func NewTopics(data ...[]byte) []Topic {
+	return newSaltedTopics(nil, data...)
+}
+
+// newSaltedTopics creates a list of salted topics from a list of binary data
+// elements, by iteratively calling newSaltedTopic on each of them.
+func newSaltedTopics(salt []byte, data ...[]byte) []Topic {
 	topics := make([]Topic, len(data))
 	for i, element := range data {
-		topics[i] = NewTopic(element)
+		topics[i] = newSaltedTopic(salt, element)
+	}
+	return topics
+}
+
+// NewFacetTopic creates a topic from a key=value facet, making the topic scheme
+// self-documenting.
+func NewFacetTopic(key, value string) Topic {
+	return newSaltedFacetTopic(nil, key, value)
+}
+
+// newSaltedFacetTopic creates a salted topic from a key=value facet.
+func newSaltedFacetTopic(salt []byte, key, value string) Topic {
+	return newSaltedTopic(salt, []byte(key+"="+value))
+}
+
+// NewFacetTopics creates the topic list of a message tagged with a set of facets,
+// one topic per facet in sorted key order. Facet based filters expect messages
+// to carry every key of their schema.
+func NewFacetTopics(facets map[string]string) []Topic {
+	return newSaltedFacetTopics(nil, facets)
+}
+
+// newSaltedFacetTopics creates the salted topic list of a message tagged with a
+// set of facets.
+func newSaltedFacetTopics(salt []byte, facets map[string]string) []Topic {
+	keys := make([]string, 0, len(facets))
+	for key := range facets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	topics := make([]Topic, len(keys))
+	for i, key := range keys {
+		topics[i] = newSaltedFacetTopic(salt, key, facets[key])
 	}
 	return topics
 }
 
+// NewTopicFromHex parses a topic from its hex representation, with or without
+// the 0x prefix.
+func NewTopicFromHex(s string) (Topic, error) {
+	blob, err := common.ParseHex(s)
+	if err != nil {
+		return Topic{}, err
+	}
+	if len(blob) != len(Topic{}) {
+		return Topic{}, fmt.Errorf("invalid topic length: have %d bytes, want %d", len(blob), len(Topic{}))
+	}
+	var topic Topic
+	copy(topic[:], blob)
+	return topic, nil
+}
+
+// TopicParseError is the failure to parse a single line of a bulk topic input.
+type TopicParseError struct {
+	Line  int    // Index of the offending line (0 based)
+	Input string // Contents of the offending line
+	Err   error  // Reason the line failed to parse
+}
+
+// Error implements error, formatting the failure with its line context.
+func (self TopicParseError) Error() string {
+	return fmt.Sprintf("line %d (%q): %v", self.Line, self.Input, self.Err)
+}
+
+// ValidateTopicHexLines parses each line as a hex topic, collecting all the
+// failures instead of stopping at the first one. It returns nil if all the lines
+// are valid.
+func ValidateTopicHexLines(lines []string) []TopicParseError {
+	var errs []TopicParseError
+	for i, line := range lines {
+		if _, err := NewTopicFromHex(line); err != nil {
+			errs = append(errs, TopicParseError{Line: i, Input: line, Err: err})
+		}
+	}
+	return errs
+}
+
+// MustNewTopicFromHex parses a topic from its hex representation, panicking if
+// the input is invalid. It is meant for initializing topic constants.
+func MustNewTopicFromHex(s string) Topic {
+	topic, err := NewTopicFromHex(s)
+	if err != nil {
+		panic(err)
+	}
+	return topic
+}
+
+// Sub derives a child topic from the 4 byte prefix of the SHA3 hash of the parent
+// topic followed by the child data. As the parent is always exactly 4 bytes, the
+// derivation is unambiguous, unlike concatenating arbitrary strings.
+func (self Topic) Sub(child []byte) Topic {
+	return self.saltedSub(nil, child)
+}
+
+// saltedSub derives a child topic from the 4 byte prefix of the SHA3 hash of the
+// salt, the parent topic and the child data.
+func (self Topic) saltedSub(salt []byte, child []byte) Topic {
+	prefix := make([]byte, 0, len(salt)+len(self))
+	prefix = append(append(prefix, salt...), self[:]...)
+	return newSaltedTopic(prefix, child)
+}
+
+// IsWildcard checks whether the topic is the empty wild-card topic, which matches
+// anything in filters and is invalid in messages.
+func (self Topic) IsWildcard() bool {
+	return self == Topic{}
+}
+
+// IsZero checks whether the topic is the zero value. It is a synonym for
+// IsWildcard, as the zero topic is the wild-card.
+func (self Topic) IsZero() bool {
+	return self.IsWildcard()
+}
+
 // String converts a topic byte array to a string representation.
 func (self *Topic) String() string {
 	return string(self[:])
 }
 
+// Hex converts a topic byte array to its 0x prefixed hex representation.
+func (self Topic) Hex() string {
+	return "0x" + hex.EncodeToString(self[:])
+}
+
+// Uint32 interprets the topic as a big endian number, e.g. to position it on a
+// consistent hashing ring.
+func (self Topic) Uint32() uint32 {
+	return binary.BigEndian.Uint32(self[:])
+}
+
+// ToBig interprets the topic as an unsigned big endian integer, e.g. for shard
+// arithmetic combining it with other, larger values.
+func (self Topic) ToBig() *big.Int {
+	return new(big.Int).SetBytes(self[:])
+}
+
+// AppendTo appends the raw bytes of the topic to dst, returning the extended
+// buffer. It does not allocate if dst has enough spare capacity.
+func (self Topic) AppendTo(dst []byte) []byte {
+	return append(dst, self[:]...)
+}
+
+// GoString implements fmt.GoStringer, formatting the topic as the Go code needed
+// to recreate it.
+func (self Topic) GoString() string {
+	return fmt.Sprintf("whisper.MustNewTopicFromHex(%q)", self.Hex())
+}
+
+// TopicInterner caches the hex representation of topics, so that hot formatting
+// paths (logs, stats) share a single string per distinct topic instead of
+// allocating a fresh one on every call. The trade-off is a lock and map lookup
+// per call, and memory retained for every interned topic; to stay bounded,
+// topics beyond the capacity are formatted without caching.
+//
+// TopicInterner is safe for concurrent use.
+type TopicInterner struct {
+	hexes map[Topic]string
+	limit int
+	lock  sync.RWMutex
+}
+
+// NewTopicInterner creates an intern table caching up to limit topics.
+func NewTopicInterner(limit int) *TopicInterner {
+	return &TopicInterner{
+		hexes: make(map[Topic]string),
+		limit: limit,
+	}
+}
+
+// Hex retrieves the shared 0x prefixed hex representation of a topic.
+func (self *TopicInterner) Hex(topic Topic) string {
+	self.lock.RLock()
+	hex, ok := self.hexes[topic]
+	self.lock.RUnlock()
+	if ok {
+		return hex
+	}
+	hex = topic.Hex()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if cached, ok := self.hexes[topic]; ok {
+		return cached
+	}
+	if len(self.hexes) < self.limit {
+		self.hexes[topic] = hex
+	}
+	return hex
+}
+
+// MatchResult is the outcome of evaluating a topic list against a matcher.
+type MatchResult int
+
+const (
+	MatchNo    MatchResult = iota // Topics definitely don't match
+	MatchMaybe                    // Topics may match (reserved for probabilistic pre-checks)
+	MatchYes                      // Topics definitely match
+)
+
+// String implements fmt.Stringer.
+func (self MatchResult) String() string {
+	switch self {
+	case MatchNo:
+		return "no"
+	case MatchMaybe:
+		return "maybe"
+	case MatchYes:
+		return "yes"
+	default:
+		return fmt.Sprintf("MatchResult(%d)", int(self))
+	}
+}
+
 // topicMatcher is a filter expression to verify if a list of topics contained
 // in an arriving message matches some topic conditions. The topic matcher is
 // built up of a list of conditions, each of which must be satisfied by the
@@ -57,7 +314,12 @@ func (self *Topic) String() string {
 // topic match; b) a match from a set of topics; or c) a wild-card matching all.
 //
 // If a message contains more topics than required by the matcher, those beyond
-// the condition count are ignored and assumed to match.
+// the condition count are ignored and assumed to match. If it contains fewer, it
+// is rejected, unless treatMissingAsWildcard is set, in which case the missing
+// trailing topics are assumed to match too. In between, optionalSlots marks only
+// that many trailing conditions as optional, so messages may omit those, but not
+// the required ones before them. Conversely, exact matchers (see Filter.Exact)
+// reject messages with extra topics beyond the conditions.
 //
 // Consider the following sample topic matcher:
 //   sample := {
@@ -71,26 +333,68 @@ func (self *Topic) String() string {
 // "TopicB", the third is ignored by the filter and the fourth either "TopicD1"
 // or "TopicD2". If the message contains further topics, the filter will match
 // them too.
+//
+// Alternatively, an unordered matcher (see Filter.Required) disregards
+// positions altogether, treating the message topics as a set that must contain
+// all of the required topics. Unordered matchers have no positional conditions.
 type topicMatcher struct {
 	conditions []map[Topic]struct{}
+	required   map[Topic]struct{} // Topics required in any position (unordered matchers only)
+
+	treatMissingAsWildcard bool // Whether to match messages shorter than the conditions
+	optionalSlots          int  // Number of trailing conditions shorter messages may omit
+	exact                  bool // Whether messages must carry exactly as many topics as conditions
 }
 
-// newTopicMatcher create a topic matcher from a list of topic conditions.
+// newTopicMatcher create a topic matcher from a list of topic conditions. Any
+// condition containing the wild-card topic is itself a wild-card.
 func newTopicMatcher(topics ...[]Topic) *topicMatcher {
 	matcher := make([]map[Topic]struct{}, len(topics))
 	for i, condition := range topics {
 		matcher[i] = make(map[Topic]struct{})
 		for _, topic := range condition {
+			if topic.IsWildcard() {
+				matcher[i] = make(map[Topic]struct{})
+				break
+			}
 			matcher[i][topic] = struct{}{}
 		}
 	}
 	return &topicMatcher{conditions: matcher}
 }
 
+// newExactTopicMatcher creates a topic matcher accepting only messages carrying
+// exactly the given sequence of topics, neither fewer nor any extra ones.
+func newExactTopicMatcher(topics ...Topic) *topicMatcher {
+	conditions := make([][]Topic, len(topics))
+	for i, topic := range topics {
+		conditions[i] = []Topic{topic}
+	}
+	matcher := newTopicMatcher(conditions...)
+	matcher.exact = true
+	return matcher
+}
+
+// newUnorderedTopicMatcher creates a topic matcher accepting messages that carry
+// all of the required topics, in any order and interleaved with any others.
+func newUnorderedTopicMatcher(required []Topic) *topicMatcher {
+	matcher := &topicMatcher{required: make(map[Topic]struct{}, len(required))}
+	for _, topic := range required {
+		matcher.required[topic] = struct{}{}
+	}
+	return matcher
+}
+
 // Matches checks if a list of topics matches this particular condition set.
 func (self *topicMatcher) Matches(topics []Topic) bool {
-	// Mismatch if there aren't enough topics
-	if len(self.conditions) > len(topics) {
+	if self.required != nil {
+		return self.contains(topics)
+	}
+	if self.exact && len(topics) != len(self.conditions) {
+		return false
+	}
+	// Mismatch if there aren't enough topics (unless missing ones are wild-cards)
+	if len(self.conditions)-self.optionalSlots > len(topics) && !self.treatMissingAsWildcard {
 		return false
 	}
 	// Check each topic condition for existence (skip wild-cards)
@@ -103,3 +407,284 @@ func (self *topicMatcher) Matches(topics []Topic) bool {
 	}
 	return true
 }
+
+// Evaluate checks a list of topics against the matcher, reporting the outcome as
+// a tri-state result. As the matcher holds the exact topic sets, it never yields
+// MatchMaybe; that is left for cheaper, probabilistic pre-checks.
+func (self *topicMatcher) Evaluate(topics []Topic) MatchResult {
+	if self.Matches(topics) {
+		return MatchYes
+	}
+	return MatchNo
+}
+
+// contains checks whether a list of topics includes all the topics required by
+// an unordered matcher.
+func (self *topicMatcher) contains(topics []Topic) bool {
+	found := 0
+	for i, topic := range topics {
+		if _, ok := self.required[topic]; !ok {
+			continue
+		}
+		// Count each required topic only once, even if listed repeatedly
+		duplicate := false
+		for _, prev := range topics[:i] {
+			if prev == topic {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			found++
+		}
+	}
+	return found == len(self.required)
+}
+
+// Subsumes checks whether every topic list accepted by another matcher is also
+// accepted by this one, e.g. to collapse redundant subscriptions. Positional
+// matchers are compared slot by slot: each concrete condition of this matcher
+// must be a superset of the other's condition in the same slot, and the other
+// must not accept shorter topic lists than this one does. Unordered matchers
+// subsume other unordered ones requiring a superset of their topics, but are
+// never compared against positional ones.
+func (self *topicMatcher) Subsumes(other *topicMatcher) bool {
+	if self.required != nil || other.required != nil {
+		if self.required == nil || other.required == nil {
+			return false
+		}
+		for topic := range self.required {
+			if _, ok := other.required[topic]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if other.minTopics() < self.minTopics() {
+		return false
+	}
+	if self.exact && (!other.exact || len(other.conditions) != len(self.conditions)) {
+		return false // the other accepts messages longer than this one does
+	}
+	for i, condition := range self.conditions {
+		if len(condition) == 0 {
+			continue
+		}
+		if i >= len(other.conditions) || len(other.conditions[i]) == 0 {
+			return false
+		}
+		for topic := range other.conditions[i] {
+			if _, ok := condition[topic]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// minTopics retrieves the minimum number of topics a message must carry for the
+// positional matcher to accept it.
+func (self *topicMatcher) minTopics() int {
+	if self.treatMissingAsWildcard || len(self.conditions) <= self.optionalSlots {
+		return 0
+	}
+	return len(self.conditions) - self.optionalSlots
+}
+
+// MatchesSlot checks if a single topic satisfies the condition at a specific
+// position, allowing messages to be evaluated one topic at a time. Wild-card
+// conditions and positions beyond the condition count always match.
+func (self *topicMatcher) MatchesSlot(slot int, topic Topic) bool {
+	if slot < 0 || slot >= len(self.conditions) || len(self.conditions[slot]) == 0 {
+		return true
+	}
+	_, ok := self.conditions[slot][topic]
+	return ok
+}
+
+// AllTopics retrieves the deduplicated union of the topics of all conditions
+// regardless of position, sorted by value, e.g. for indexing or bloom building.
+// Wild-card conditions contribute nothing. For unordered matchers these are the
+// required topics.
+func (self *topicMatcher) AllTopics() []Topic {
+	union := make(map[Topic]struct{})
+	for topic := range self.required {
+		union[topic] = struct{}{}
+	}
+	for _, condition := range self.conditions {
+		for topic := range condition {
+			union[topic] = struct{}{}
+		}
+	}
+	topics := make([]Topic, 0, len(union))
+	for topic := range union {
+		topics = append(topics, topic)
+	}
+	sort.Sort(topicsByValue(topics))
+	return topics
+}
+
+// WildcardSlots retrieves the positions of the wild-card conditions, which accept
+// any topic in the corresponding message slot.
+func (self *topicMatcher) WildcardSlots() []int {
+	var slots []int
+	for i, condition := range self.conditions {
+		if len(condition) == 0 {
+			slots = append(slots, i)
+		}
+	}
+	return slots
+}
+
+// Fingerprint computes a stable hash of the matcher's conditions and matching
+// modes, independent of the order the topics were listed in at construction, so
+// identical filters can be grouped (e.g. in logs or metrics) by a short id.
+func (self *topicMatcher) Fingerprint() common.Hash {
+	var flags byte
+	if self.required != nil {
+		flags |= 1
+	}
+	if self.treatMissingAsWildcard {
+		flags |= 2
+	}
+	if self.exact {
+		flags |= 4
+	}
+	blob := []byte{flags}
+	blob = appendUint32(blob, uint32(self.optionalSlots))
+
+	blob = appendTopicSet(blob, self.required)
+	blob = appendUint32(blob, uint32(len(self.conditions)))
+	for _, condition := range self.conditions {
+		blob = appendTopicSet(blob, condition)
+	}
+	return common.BytesToHash(crypto.Keccak256(blob))
+}
+
+// appendTopicSet appends the size and the value sorted topics of a set to a byte
+// slice, yielding a canonical encoding regardless of map iteration order.
+func appendTopicSet(dst []byte, set map[Topic]struct{}) []byte {
+	topics := make([]Topic, 0, len(set))
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Sort(topicsByValue(topics))
+
+	dst = appendUint32(dst, uint32(len(topics)))
+	for _, topic := range topics {
+		dst = topic.AppendTo(dst)
+	}
+	return dst
+}
+
+// appendUint32 appends the big endian encoding of a number to a byte slice.
+func appendUint32(dst []byte, n uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], n)
+	return append(dst, buf[:]...)
+}
+
+// Selectivity estimates the fraction of messages with uniformly random topics
+// that the matcher would accept, based on the cardinality of each condition.
+// Wild-card conditions accept everything, so an all wild-card matcher yields 1.
+//
+// Conditions that shorter messages may omit (the optional slots, or all of them
+// for lenient matchers) are credited as accepting everything, as the message may
+// well not carry them. Exact matchers get no such credit, demanding all of their
+// conditions, and unordered matchers demand each of their required topics.
+func (self *topicMatcher) Selectivity() float64 {
+	selectivity := 1.0
+	for range self.required {
+		selectivity /= 1 << 32
+	}
+	demanded := len(self.conditions)
+	if !self.exact {
+		demanded = self.minTopics()
+	}
+	for _, condition := range self.conditions[:demanded] {
+		if len(condition) > 0 {
+			selectivity *= float64(len(condition)) / (1 << 32)
+		}
+	}
+	return selectivity
+}
+
+// matcherIndex is a dispatch index over a fixed set of topic matchers, bucketing
+// them by their first condition so that evaluating a message only visits the
+// matchers that could possibly accept its first topic.
+type matcherIndex struct {
+	matchers  []*topicMatcher
+	heads     map[Topic][]int // Matchers requiring one of a set of first topics
+	wildcards []int           // Matchers accepting any first topic
+}
+
+// newMatcherIndex creates a dispatch index over a list of topic matchers.
+func newMatcherIndex(matchers []*topicMatcher) *matcherIndex {
+	index := &matcherIndex{
+		matchers: matchers,
+		heads:    make(map[Topic][]int),
+	}
+	for i, matcher := range matchers {
+		if len(matcher.conditions) == 0 || len(matcher.conditions[0]) == 0 {
+			index.wildcards = append(index.wildcards, i)
+			continue
+		}
+		for topic := range matcher.conditions[0] {
+			index.heads[topic] = append(index.heads[topic], i)
+		}
+	}
+	return index
+}
+
+// EvaluateMany checks a list of topics against all the indexed matchers, returning
+// the indices of the matching ones in ascending order.
+func (self *matcherIndex) EvaluateMany(topics []Topic) []int {
+	// Messages without topics can only be matched by the lenient matchers, which
+	// the index cannot tell apart, so check all of them
+	var candidates []int
+	if len(topics) == 0 {
+		candidates = make([]int, len(self.matchers))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	} else {
+		candidates = append(append([]int(nil), self.heads[topics[0]]...), self.wildcards...)
+		sort.Ints(candidates)
+	}
+	matches := candidates[:0]
+	for _, i := range candidates {
+		if self.matchers[i].Matches(topics) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// combinedSlot0Topics collects the deduplicated union of the first topic conditions
+// of a set of matchers, sorted by value, e.g. to summarize the interests of all
+// the local subscriptions. If any matcher accepts arbitrary first topics, no list
+// can cover it, so nil is returned along with a match-all indicator.
+func combinedSlot0Topics(matchers []*topicMatcher) ([]Topic, bool) {
+	union := make(map[Topic]struct{})
+	for _, matcher := range matchers {
+		if len(matcher.conditions) == 0 || len(matcher.conditions[0]) == 0 {
+			return nil, true
+		}
+		for topic := range matcher.conditions[0] {
+			union[topic] = struct{}{}
+		}
+	}
+	topics := make([]Topic, 0, len(union))
+	for topic := range union {
+		topics = append(topics, topic)
+	}
+	sort.Sort(topicsByValue(topics))
+	return topics, false
+}
+
+// topicsByValue implements sort.Interface, ordering topics by their value.
+type topicsByValue []Topic
+
+func (self topicsByValue) Len() int           { return len(self) }
+func (self topicsByValue) Less(i, j int) bool { return self[i].Uint32() < self[j].Uint32() }
+func (self topicsByValue) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
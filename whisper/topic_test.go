@@ -18,7 +18,15 @@ package whisper
 
 import (
 	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
 	"testing"
+
+	"github.com/aiblocksproject/go-aiblocks/common"
+	"github.com/aiblocksproject/go-aiblocks/crypto"
+	"github.com/aiblocksproject/go-aiblocks/rlp"
 )
 
 var topicCreationTests = []struct {
@@ -67,6 +75,184 @@ func TestTopicCreation(t *testing.T) {
 	}
 }
 
+// Benchmarks topic creation across input sizes. The hasher absorbs the input in
+// place, so allocations should stay constant regardless of the data length.
+func BenchmarkNewTopic(b *testing.B) {
+	for _, size := range []int{32, 1024, 1024 * 1024, 16 * 1024 * 1024} {
+		data := make([]byte, size)
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				NewTopic(data)
+			}
+		})
+	}
+}
+
+// Benchmarks repeated topic creation through the pooled hasher against hashing
+// with a freshly allocated state for every call.
+func BenchmarkNewTopicPooled(b *testing.B) {
+	data := []byte("benchmark topic")
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			NewTopic(data)
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			prefix := [4]byte{}
+			copy(prefix[:], crypto.Keccak256(data)[:4])
+		}
+	})
+}
+
+// Benchmarks repeatedly formatting a handful of topics directly and through an
+// intern table.
+func BenchmarkTopicHex(b *testing.B) {
+	var sink string
+	topics := newTopicsFromStrings("a", "b", "c", "d")
+
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sink = topics[i%len(topics)].Hex()
+		}
+	})
+	b.Run("interned", func(b *testing.B) {
+		interner := NewTopicInterner(len(topics))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sink = interner.Hex(topics[i%len(topics)])
+		}
+	})
+	_ = sink
+}
+
+func TestTopicToBig(t *testing.T) {
+	tests := []struct {
+		topic Topic
+		value uint64
+	}{
+		{Topic{}, 0},
+		{Topic{0x00, 0x00, 0x00, 0x01}, 1},
+		{Topic{0x01, 0x02, 0x03, 0x04}, 0x01020304},
+		{Topic{0xff, 0xff, 0xff, 0xff}, 0xffffffff},
+	}
+	for i, tt := range tests {
+		if value := tt.topic.ToBig(); value.Sign() < 0 || value.Uint64() != tt.value {
+			t.Errorf("test %d: value mismatch: have %v, want %d", i, value, tt.value)
+		}
+		if value := tt.topic.ToBig().Uint64(); value != uint64(tt.topic.Uint32()) {
+			t.Errorf("test %d: uint32 mismatch: have %d, want %d", i, value, tt.topic.Uint32())
+		}
+	}
+}
+
+func TestTopicAppendTo(t *testing.T) {
+	topics := newTopicsFromStrings("a", "b")
+
+	var blob []byte
+	for _, topic := range topics {
+		blob = topic.AppendTo(blob)
+	}
+	if want := append(topics[0][:], topics[1][:]...); !bytes.Equal(blob, want) {
+		t.Fatalf("appended topics mismatch: have %x, want %x", blob, want)
+	}
+}
+
+// Benchmarks appending topics into a buffer with enough spare capacity.
+func BenchmarkTopicAppendTo(b *testing.B) {
+	topics := newTopicsFromStrings("a", "b", "c", "d")
+	buffer := make([]byte, 0, len(topics)*len(Topic{}))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer = buffer[:0]
+		for _, topic := range topics {
+			buffer = topic.AppendTo(buffer)
+		}
+	}
+}
+
+func TestTopicInterner(t *testing.T) {
+	interner := NewTopicInterner(1)
+
+	// Ensure interned topics format correctly and beyond the limit too
+	for _, topic := range newTopicsFromStrings("a", "b", "a") {
+		if have, want := interner.Hex(topic), topic.Hex(); have != want {
+			t.Errorf("topic %x: hex mismatch: have %s, want %s", topic, have, want)
+		}
+	}
+	if len(interner.hexes) != 1 {
+		t.Errorf("interned topic count mismatch: have %d, want %d", len(interner.hexes), 1)
+	}
+}
+
+func TestTopicGoString(t *testing.T) {
+	topic := Topic{0xab, 0xcd, 0x12, 0x34}
+
+	if have, want := topic.GoString(), `whisper.MustNewTopicFromHex("0xabcd1234")`; have != want {
+		t.Errorf("topic GoString mismatch: have %s, want %s", have, want)
+	}
+	wrapped := struct{ Topics []Topic }{[]Topic{topic}}
+	if have, want := fmt.Sprintf("%#v", wrapped), `struct { Topics []whisper.Topic }{Topics:[]whisper.Topic{whisper.MustNewTopicFromHex("0xabcd1234")}}`; have != want {
+		t.Errorf("wrapped topic GoString mismatch: have %s, want %s", have, want)
+	}
+	if parsed := MustNewTopicFromHex(topic.Hex()); parsed != topic {
+		t.Errorf("hex round-trip mismatch: have %x, want %x", parsed, topic)
+	}
+}
+
+var topicHexTests = []struct {
+	input string
+	topic Topic
+	fail  bool
+}{
+	{input: "0xabcd1234", topic: Topic{0xab, 0xcd, 0x12, 0x34}},
+	{input: "abcd1234", topic: Topic{0xab, 0xcd, 0x12, 0x34}},
+	{input: "0XABCD1234", topic: Topic{0xab, 0xcd, 0x12, 0x34}},
+	{input: "0xabcd12", fail: true},
+	{input: "0xabcd123456", fail: true},
+	{input: "0xabcd123", fail: true},
+	{input: "0xabcdxyzw", fail: true},
+}
+
+func TestTopicFromHex(t *testing.T) {
+	for i, tt := range topicHexTests {
+		topic, err := NewTopicFromHex(tt.input)
+		if (err != nil) != tt.fail {
+			t.Errorf("test %d: failure mismatch: have %v, want failure %v", i, err, tt.fail)
+			continue
+		}
+		if err == nil && topic != tt.topic {
+			t.Errorf("test %d: topic mismatch: have %x, want %x", i, topic, tt.topic)
+		}
+	}
+}
+
+func TestValidateTopicHexLines(t *testing.T) {
+	// Ensure valid inputs report no errors
+	if errs := ValidateTopicHexLines([]string{"0x01020304", "0a0b0c0d"}); errs != nil {
+		t.Fatalf("valid lines rejected: %v", errs)
+	}
+	// Ensure all invalid lines are reported with their indices
+	lines := []string{"0x01020304", "0x010203", "", "0xdeadbeef", "0xzz020304", "0x0102030405"}
+	errs := ValidateTopicHexLines(lines)
+
+	want := []int{1, 2, 4, 5}
+	if len(errs) != len(want) {
+		t.Fatalf("error count mismatch: have %d, want %d: %v", len(errs), len(want), errs)
+	}
+	for i, err := range errs {
+		if err.Line != want[i] || err.Input != lines[want[i]] || err.Err == nil {
+			t.Errorf("error %d: mismatch: have line %d (%q, %v), want line %d (%q)", i, err.Line, err.Input, err.Err, want[i], lines[want[i]])
+		}
+	}
+}
+
 var topicMatcherCreationTest = struct {
 	binary  [][][]byte
 	textual [][]string
@@ -214,6 +400,441 @@ func TestTopicMatcher(t *testing.T) {
 	}
 }
 
+func TestTopicMatcherSlot(t *testing.T) {
+	matcher := newTopicMatcherFromStrings([]string{"a1", "a2"}, []string{}, []string{"c"})
+
+	tests := []struct {
+		slot  int
+		topic string
+		match bool
+	}{
+		{slot: 0, topic: "a1", match: true},  // set hit
+		{slot: 0, topic: "a2", match: true},  // set hit
+		{slot: 0, topic: "b", match: false},  // set miss
+		{slot: 1, topic: "b", match: true},   // wild-card
+		{slot: 2, topic: "c", match: true},   // exact hit
+		{slot: 2, topic: "a1", match: false}, // exact miss
+		{slot: 3, topic: "d", match: true},   // out of range, extra topic
+	}
+	for i, tt := range tests {
+		if match := matcher.MatchesSlot(tt.slot, newTopicFromString(tt.topic)); match != tt.match {
+			t.Errorf("test %d: slot %d match mismatch: have %v, want %v", i, tt.slot, match, tt.match)
+		}
+	}
+}
+
+func TestTopicMatcherEvaluate(t *testing.T) {
+	matcher := newTopicMatcher(newFilterTopicsFromStrings([]string{"a", "b"}, nil, []string{"c"})...)
+
+	tests := []struct {
+		topics []string
+		result MatchResult
+	}{
+		{topics: []string{"a", "x", "c"}, result: MatchYes},
+		{topics: []string{"b", "y", "c", "z"}, result: MatchYes},
+		{topics: []string{"x", "x", "c"}, result: MatchNo},
+		{topics: []string{"a", "x"}, result: MatchNo},
+	}
+	for i, tt := range tests {
+		if have := matcher.Evaluate(newTopicsFromStrings(tt.topics...)); have != tt.result {
+			t.Errorf("test %d: result mismatch: have %v, want %v", i, have, tt.result)
+		}
+	}
+}
+
+func TestTopicMatcherMissingAsWildcard(t *testing.T) {
+	strict := newTopicMatcherFromStrings([]string{"a"}, []string{"b"}, []string{"c"})
+	lenient := newTopicMatcherFromStrings([]string{"a"}, []string{"b"}, []string{"c"})
+	lenient.treatMissingAsWildcard = true
+	optional := newTopicMatcherFromStrings([]string{"a"}, []string{"b"}, []string{"c"})
+	optional.optionalSlots = 1
+
+	tests := []struct {
+		topics   []string
+		strict   bool
+		lenient  bool
+		optional bool
+	}{
+		{topics: []string{"a", "b", "c"}, strict: true, lenient: true, optional: true},      // full match
+		{topics: []string{"a", "b"}, strict: false, lenient: true, optional: true},          // missing optional trailing topic
+		{topics: []string{"a"}, strict: false, lenient: true, optional: false},              // missing required topic
+		{topics: []string{}, strict: false, lenient: true, optional: false},                 // all topics missing
+		{topics: []string{"a", "x"}, strict: false, lenient: false, optional: false},        // present topic mismatch
+		{topics: []string{"a", "b", "c", "d"}, strict: true, lenient: true, optional: true}, // extra trailing topic
+	}
+	for i, tt := range tests {
+		topics := newTopicsFromStrings(tt.topics...)
+		if match := strict.Matches(topics); match != tt.strict {
+			t.Errorf("test %d: strict match mismatch: have %v, want %v", i, match, tt.strict)
+		}
+		if match := lenient.Matches(topics); match != tt.lenient {
+			t.Errorf("test %d: lenient match mismatch: have %v, want %v", i, match, tt.lenient)
+		}
+		if match := optional.Matches(topics); match != tt.optional {
+			t.Errorf("test %d: optional match mismatch: have %v, want %v", i, match, tt.optional)
+		}
+	}
+}
+
+func TestTopicSub(t *testing.T) {
+	room := NewTopic([]byte("room"))
+
+	// Children of the same parent must be stable and distinct
+	alice, bob := room.Sub([]byte("alice")), room.Sub([]byte("bob"))
+	if alice != room.Sub([]byte("alice")) {
+		t.Fatalf("child topic unstable: %x != %x", alice, room.Sub([]byte("alice")))
+	}
+	if alice == bob {
+		t.Fatalf("distinct children collide: %x", alice)
+	}
+	// Children must not collide with their parents or flat derivations
+	if alice == room || alice == NewTopic([]byte("alice")) || alice == NewTopic([]byte("roomalice")) {
+		t.Fatalf("child topic collides with non hierarchical derivation: %x", alice)
+	}
+	// The same child of different parents must be distinct
+	if alice == NewTopic([]byte("lobby")).Sub([]byte("alice")) {
+		t.Fatalf("children of distinct parents collide: %x", alice)
+	}
+}
+
+func TestTopicZero(t *testing.T) {
+	// Ensure the two names of the wild-card agree
+	for i, topic := range []Topic{{}, newTopicFromString("a"), {0, 0, 0, 1}} {
+		if topic.IsZero() != topic.IsWildcard() {
+			t.Errorf("topic %d: zero/wildcard mismatch: zero %v, wildcard %v", i, topic.IsZero(), topic.IsWildcard())
+		}
+		if want := topic == (Topic{}); topic.IsZero() != want {
+			t.Errorf("topic %d: zero check mismatch: have %v, want %v", i, topic.IsZero(), want)
+		}
+	}
+	// Ensure the zero topic is a wild-card in matchers
+	matcher := newTopicMatcher([]Topic{newTopicFromString("a"), {}}, newTopicsFromStrings("b"))
+	if !matcher.Matches(newTopicsFromStrings("x", "b")) {
+		t.Errorf("zero topic condition not treated as wild-card")
+	}
+	// Ensure the zero topic is rejected in messages
+	if _, err := NewMessage([]byte("zero")).Wrap(0, Options{Topics: []Topic{{}}}); err == nil {
+		t.Errorf("message wrapped with zero topic")
+	}
+	blob, _ := rlp.EncodeToBytes(&Envelope{Topics: []Topic{{}}, Data: []byte{0}})
+	if _, err := DecodeEnvelope(blob); err == nil {
+		t.Errorf("envelope decoded with zero topic")
+	}
+}
+
+func TestMatcherIndex(t *testing.T) {
+	matchers := []*topicMatcher{
+		newTopicMatcher(newFilterTopicsFromStrings([]string{"a"})...),
+		newTopicMatcher(newFilterTopicsFromStrings([]string{"a", "b"}, []string{"c"})...),
+		newTopicMatcher(newFilterTopicsFromStrings(nil, []string{"c"})...),
+		newTopicMatcher(),
+		newTopicMatcher(newFilterTopicsFromStrings([]string{"b"}, []string{"d"})...),
+	}
+	matchers[4].treatMissingAsWildcard = true
+
+	index := newMatcherIndex(matchers)
+	tests := []struct {
+		topics  []string
+		matches []int
+	}{
+		{topics: nil, matches: []int{3, 4}},
+		{topics: []string{"a"}, matches: []int{0, 3}},
+		{topics: []string{"a", "c"}, matches: []int{0, 1, 2, 3}},
+		{topics: []string{"b"}, matches: []int{3, 4}},
+		{topics: []string{"b", "c"}, matches: []int{1, 2, 3}},
+		{topics: []string{"x", "c"}, matches: []int{2, 3}},
+	}
+	for i, tt := range tests {
+		topics := newTopicsFromStrings(tt.topics...)
+		if matches := index.EvaluateMany(topics); !reflect.DeepEqual(matches, tt.matches) {
+			t.Errorf("test %d: matches mismatch: have %v, want %v", i, matches, tt.matches)
+		}
+		// Cross check against naive evaluation
+		var naive []int
+		for j, matcher := range matchers {
+			if matcher.Matches(topics) {
+				naive = append(naive, j)
+			}
+		}
+		if !reflect.DeepEqual(naive, tt.matches) {
+			t.Errorf("test %d: naive matches mismatch: have %v, want %v", i, naive, tt.matches)
+		}
+	}
+}
+
+// Benchmarks evaluating a message against 10K matchers, naively one by one and
+// through the dispatch index.
+func BenchmarkMatcherIndex(b *testing.B) {
+	matchers := make([]*topicMatcher, 10000)
+	for i := range matchers {
+		head := []string{fmt.Sprintf("head %d", i)}
+		if i%100 == 0 {
+			head = nil // sprinkle in some wild-cards
+		}
+		matchers[i] = newTopicMatcher(newFilterTopicsFromStrings(head, []string{"tail"})...)
+	}
+	topics := newTopicsFromStrings("head 1", "tail")
+
+	b.Run("naive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, matcher := range matchers {
+				matcher.Matches(topics)
+			}
+		}
+	})
+	b.Run("indexed", func(b *testing.B) {
+		index := newMatcherIndex(matchers)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			index.EvaluateMany(topics)
+		}
+	})
+}
+
+func TestCombinedSlot0Topics(t *testing.T) {
+	matchers := []*topicMatcher{
+		newTopicMatcher(newFilterTopicsFromStrings([]string{"a", "b"})...),
+		newTopicMatcher(newFilterTopicsFromStrings([]string{"b", "c"}, []string{"d"})...),
+	}
+	// Ensure concrete first conditions are merged and deduplicated
+	topics, all := combinedSlot0Topics(matchers)
+	if all {
+		t.Fatalf("concrete matchers reported as match-all")
+	}
+	want := newTopicsFromStrings("a", "b", "c")
+	sort.Sort(topicsByValue(want))
+	if !reflect.DeepEqual(topics, want) {
+		t.Fatalf("combined topics mismatch: have %x, want %x", topics, want)
+	}
+	// Ensure a wild-card first condition forces matching everything
+	matchers = append(matchers, newTopicMatcher(newFilterTopicsFromStrings(nil, []string{"e"})...))
+	if topics, all := combinedSlot0Topics(matchers); !all || topics != nil {
+		t.Fatalf("wildcard combination mismatch: have %x/%v, want nil/true", topics, all)
+	}
+}
+
+func TestExactTopicMatcher(t *testing.T) {
+	matcher := newExactTopicMatcher(newTopicsFromStrings("a", "b")...)
+
+	tests := []struct {
+		topics []string
+		match  bool
+	}{
+		{topics: []string{"a", "b"}, match: true},
+		{topics: []string{"b", "a"}, match: false},
+		{topics: []string{"a"}, match: false},
+		{topics: []string{"a", "b", "c"}, match: false},
+	}
+	for i, tt := range tests {
+		if match := matcher.Matches(newTopicsFromStrings(tt.topics...)); match != tt.match {
+			t.Errorf("test %d: match mismatch for %v: have %v, want %v", i, tt.topics, match, tt.match)
+		}
+	}
+}
+
+func TestUnorderedTopicMatcher(t *testing.T) {
+	matcher := newUnorderedTopicMatcher(newTopicsFromStrings("a", "b"))
+
+	tests := []struct {
+		topics []string
+		match  bool
+	}{
+		{topics: []string{"a", "b"}, match: true},
+		{topics: []string{"b", "a"}, match: true},
+		{topics: []string{"c", "b", "d", "a"}, match: true},
+		{topics: []string{"a", "a"}, match: false},
+		{topics: []string{"b", "c"}, match: false},
+		{topics: nil, match: false},
+	}
+	for i, tt := range tests {
+		if match := matcher.Matches(newTopicsFromStrings(tt.topics...)); match != tt.match {
+			t.Errorf("test %d: match mismatch for %v: have %v, want %v", i, tt.topics, match, tt.match)
+		}
+	}
+}
+
+func TestTopicMatcherAllTopics(t *testing.T) {
+	matcher := newTopicMatcher(newFilterTopicsFromStrings([]string{"a", "b"}, nil, []string{"b", "c"}, []string{""})...)
+
+	want := newTopicsFromStrings("a", "b", "c")
+	sort.Sort(topicsByValue(want))
+	if topics := matcher.AllTopics(); !reflect.DeepEqual(topics, want) {
+		t.Fatalf("topic union mismatch: have %x, want %x", topics, want)
+	}
+	if topics := newTopicMatcher(nil, nil).AllTopics(); len(topics) != 0 {
+		t.Fatalf("wildcard topic union mismatch: have %x, want none", topics)
+	}
+}
+
+func TestTopicMatcherFingerprint(t *testing.T) {
+	base := newTopicMatcherFromStrings([]string{"a", "b", "c"}, nil, []string{"d"})
+	reordered := newTopicMatcherFromStrings([]string{"c", "a", "b"}, []string{}, []string{"d"})
+	if base.Fingerprint() != reordered.Fingerprint() {
+		t.Fatalf("equivalent matchers fingerprint mismatch: %x != %x", base.Fingerprint(), reordered.Fingerprint())
+	}
+	if base.Fingerprint() != base.Fingerprint() {
+		t.Fatalf("fingerprint not stable across calls")
+	}
+	if a, b := newUnorderedTopicMatcher(newTopicsFromStrings("a", "b")), newUnorderedTopicMatcher(newTopicsFromStrings("b", "a", "b")); a.Fingerprint() != b.Fingerprint() {
+		t.Fatalf("equivalent unordered matchers fingerprint mismatch: %x != %x", a.Fingerprint(), b.Fingerprint())
+	}
+	lenient := newTopicMatcherFromStrings([]string{"a", "b", "c"}, nil, []string{"d"})
+	lenient.treatMissingAsWildcard = true
+
+	optional := newTopicMatcherFromStrings([]string{"a", "b", "c"}, nil, []string{"d"})
+	optional.optionalSlots = 1
+
+	different := []*topicMatcher{
+		newTopicMatcherFromStrings([]string{"a", "b"}, nil, []string{"d"}),
+		newTopicMatcherFromStrings([]string{"a", "b", "c"}, []string{"d"}, nil),
+		newTopicMatcherFromStrings([]string{"a", "b", "c"}, nil, []string{"d"}, nil),
+		newTopicMatcherFromStrings([]string{"a", "b", "c"}, []string{"d"}),
+		newUnorderedTopicMatcher(newTopicsFromStrings("a", "b", "c", "d")),
+		newExactTopicMatcher(newTopicsFromStrings("a", "d")...),
+		newTopicMatcherFromStrings([]string{"a"}, []string{"d"}),
+		lenient,
+		optional,
+	}
+	seen := map[common.Hash]int{base.Fingerprint(): -1}
+	for i, matcher := range different {
+		fingerprint := matcher.Fingerprint()
+		if j, ok := seen[fingerprint]; ok {
+			t.Errorf("matcher %d: fingerprint collides with matcher %d: %x", i, j, fingerprint)
+		}
+		seen[fingerprint] = i
+	}
+}
+
+func TestTopicMatcherSubsumes(t *testing.T) {
+	lenient := newTopicMatcherFromStrings([]string{"a"}, []string{"b"})
+	lenient.treatMissingAsWildcard = true
+
+	tests := []struct {
+		a, b       *topicMatcher
+		aSubsumesB bool
+		bSubsumesA bool
+	}{
+		// Equal matchers subsume each other
+		{
+			a:          newTopicMatcherFromStrings([]string{"a", "b"}, nil),
+			b:          newTopicMatcherFromStrings([]string{"b", "a"}, nil),
+			aSubsumesB: true, bSubsumesA: true,
+		},
+		// Strict subsumption by wider conditions, wild-cards and fewer slots
+		{
+			a:          newTopicMatcherFromStrings([]string{"a", "b"}),
+			b:          newTopicMatcherFromStrings([]string{"a"}),
+			aSubsumesB: true, bSubsumesA: false,
+		},
+		{
+			a:          newTopicMatcherFromStrings([]string{"a"}, nil),
+			b:          newTopicMatcherFromStrings([]string{"a"}, []string{"c"}),
+			aSubsumesB: true, bSubsumesA: false,
+		},
+		{
+			a:          newTopicMatcherFromStrings([]string{"a"}),
+			b:          newTopicMatcherFromStrings([]string{"a"}, []string{"b"}),
+			aSubsumesB: true, bSubsumesA: false,
+		},
+		// Lenient matchers accept shorter messages, subsuming strict ones
+		{
+			a:          lenient,
+			b:          newTopicMatcherFromStrings([]string{"a"}, []string{"b"}),
+			aSubsumesB: true, bSubsumesA: false,
+		},
+		// Incomparable matchers
+		{
+			a:          newTopicMatcherFromStrings([]string{"a"}, nil),
+			b:          newTopicMatcherFromStrings(nil, []string{"b"}),
+			aSubsumesB: false, bSubsumesA: false,
+		},
+		{
+			a:          newTopicMatcherFromStrings([]string{"a", "b"}),
+			b:          newTopicMatcherFromStrings([]string{"b", "c"}),
+			aSubsumesB: false, bSubsumesA: false,
+		},
+		// Unordered matchers only compare among themselves
+		{
+			a:          newUnorderedTopicMatcher(newTopicsFromStrings("a")),
+			b:          newUnorderedTopicMatcher(newTopicsFromStrings("a", "b")),
+			aSubsumesB: true, bSubsumesA: false,
+		},
+		{
+			a:          newUnorderedTopicMatcher(newTopicsFromStrings("a")),
+			b:          newTopicMatcherFromStrings([]string{"a"}),
+			aSubsumesB: false, bSubsumesA: false,
+		},
+	}
+	for i, tt := range tests {
+		if have := tt.a.Subsumes(tt.b); have != tt.aSubsumesB {
+			t.Errorf("test %d: a subsumes b mismatch: have %v, want %v", i, have, tt.aSubsumesB)
+		}
+		if have := tt.b.Subsumes(tt.a); have != tt.bSubsumesA {
+			t.Errorf("test %d: b subsumes a mismatch: have %v, want %v", i, have, tt.bSubsumesA)
+		}
+	}
+}
+
+func TestTopicMatcherWildcardSlots(t *testing.T) {
+	tests := []struct {
+		conditions [][]string
+		slots      []int
+	}{
+		{conditions: nil, slots: nil},
+		{conditions: [][]string{{"a"}, {"b", "c"}}, slots: nil},
+		{conditions: [][]string{nil, {"a"}, {""}, {"b"}, nil}, slots: []int{0, 2, 4}},
+	}
+	for i, tt := range tests {
+		slots := newTopicMatcher(newFilterTopicsFromStrings(tt.conditions...)...).WildcardSlots()
+		if !reflect.DeepEqual(slots, tt.slots) {
+			t.Errorf("test %d: wildcard slots mismatch: have %v, want %v", i, slots, tt.slots)
+		}
+	}
+}
+
+func TestTopicMatcherSelectivity(t *testing.T) {
+	// Wild-card matchers accept everything
+	for i, matcher := range []*topicMatcher{newTopicMatcher(), newTopicMatcherFromStrings([]string{}, []string{})} {
+		if have := matcher.Selectivity(); math.Abs(have-1) > 1e-9 {
+			t.Errorf("wild-card %d: selectivity mismatch: have %v, want %v", i, have, 1.0)
+		}
+	}
+	// Single topic matchers accept a single topic out of the whole space
+	tight := newTopicMatcherFromStrings([]string{"a"})
+	if have, want := tight.Selectivity(), 1.0/(1<<32); math.Abs(have-want) > want*1e-9 {
+		t.Errorf("single topic selectivity mismatch: have %v, want %v", have, want)
+	}
+	// Multi slot matchers multiply the acceptance of each condition
+	loose := newTopicMatcherFromStrings([]string{"a", "b"}, []string{}, []string{"c"})
+	if have, want := loose.Selectivity(), 2.0/(1<<32)/(1<<32); math.Abs(have-want) > want*1e-9 {
+		t.Errorf("multi slot selectivity mismatch: have %v, want %v", have, want)
+	}
+	// Optional conditions may be omitted, so they are credited as wild-cards
+	optional := newTopicMatcherFromStrings([]string{"a"}, []string{"b"})
+	optional.optionalSlots = 1
+	if have, want := optional.Selectivity(), 1.0/(1<<32); math.Abs(have-want) > want*1e-9 {
+		t.Errorf("optional slot selectivity mismatch: have %v, want %v", have, want)
+	}
+	lenient := newTopicMatcherFromStrings([]string{"a"}, []string{"b"})
+	lenient.treatMissingAsWildcard = true
+	if have := lenient.Selectivity(); math.Abs(have-1) > 1e-9 {
+		t.Errorf("lenient selectivity mismatch: have %v, want %v", have, 1.0)
+	}
+	// Exact and unordered matchers demand all of their topics
+	exact := newExactTopicMatcher(newTopicsFromStrings("a", "b")...)
+	exact.optionalSlots = 1
+	unordered := newUnorderedTopicMatcher(newTopicsFromStrings("a", "b"))
+
+	for name, matcher := range map[string]*topicMatcher{"exact": exact, "unordered": unordered} {
+		if have, want := matcher.Selectivity(), 1.0/(1<<32)/(1<<32); math.Abs(have-want) > want*1e-9 {
+			t.Errorf("%s selectivity mismatch: have %v, want %v", name, have, want)
+		}
+		if matcher.Selectivity() >= optional.Selectivity() {
+			t.Errorf("%s matcher ranked looser than positional one with optional slots", name)
+		}
+	}
+}
+
 // NewTopicFromString creates a topic using the binary data contents of the
 // specified string.
 func newTopicFromString(data string) Topic {
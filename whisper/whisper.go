@@ -17,7 +17,13 @@
 package whisper
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,6 +34,7 @@ import (
 	"github.com/aiblocksproject/go-aiblocks/logger"
 	"github.com/aiblocksproject/go-aiblocks/logger/glog"
 	"github.com/aiblocksproject/go-aiblocks/p2p"
+	"github.com/aiblocksproject/go-aiblocks/rlp"
 	"github.com/aiblocksproject/go-aiblocks/rpc"
 
 	"gopkg.in/fatih/set.v0"
@@ -43,49 +50,221 @@ const (
 	signatureFlag   = byte(1 << 7)
 	signatureLength = 65
 
+	headerReplyTo = byte(1 << 0) // Payload header carries a reply topic
+	headerType    = byte(1 << 1) // Payload header carries a payload type tag
+	maxTypeLength = 255
+
 	expirationCycle   = 800 * time.Millisecond
 	transmissionCycle = 300 * time.Millisecond
+
+	knownExactLimit = 16384 // Known envelopes tracked exactly per peer before falling back to a bloom filter
+	knownBloomItems = 65536 // Number of envelopes the per peer bloom filter is sized for
+	knownBloomRate  = 0.001 // Target false positive rate of the per peer bloom filter
+
+	maxPinnedEnvelopes = 64 // Maximum number of envelopes exempted from expiration
+	maxEnvelopeTopics  = 64 // Maximum number of topics an envelope may be tagged with
+
+	storeTailBuffer = 256  // Envelopes buffered per store tail before dropping for a lagging consumer
+	replayBacklog   = 4096 // Live messages held back per filter during a warm-up replay before dropping the oldest
 )
 
 const (
 	DefaultTTL = 50 * time.Second
 	DefaultPoW = 50 * time.Millisecond
+
+	DefaultMaxSubscriptions = 4096 // Default cap on the subscriptions installed via Subscribe
+	DefaultBroadcastLimit   = 1024 // Default cap on the envelopes forwarded to a peer per transmission cycle
 )
 
+var (
+	ErrNoReplyTopic = errors.New("message has no reply topic")
+	ErrTooManyPins  = errors.New("too many pinned envelopes")
+
+	ErrTooManySubscriptions = errors.New("too many subscriptions")
+	ErrWildcardTopic        = errors.New("wildcard topic cannot be used in messages")
+	ErrUnknownFilter        = errors.New("unknown filter")
+	ErrNotNarrower          = errors.New("topics are not narrower than the filter's")
+	ErrUnorderedFilter      = errors.New("unordered filter has no positional topics")
+	ErrUnknownFacet         = errors.New("facet key not in schema")
+)
+
+// probeTopicData is the data the reserved topic of the latency probes is derived
+// from (salted as any other topic). Probes are acknowledged by their recipients
+// instead of being delivered to the local filters.
+var probeTopicData = []byte("whisper-latency-probe")
+
+// Config contains the optional settings of a whisper node.
+type Config struct {
+	Store Store // Message store backend to retain envelopes in (nil = in-memory)
+
+	// TopicSalt is a secret mixed into all topics derived through the node (its
+	// topic, facet and sub-topic constructors, and the latency probe topic), making
+	// them unguessable to outsiders. Only nodes sharing the same salt compute
+	// matching topics, so nodes with mixed salts will not interoperate. The package
+	// level constructors remain unsalted.
+	TopicSalt []byte
+
+	// TopicPriorities orders outgoing transmissions, envelopes tagged with higher
+	// priority topics being sent first. Envelopes with multiple topics take their
+	// highest priority, unlisted topics default to zero. Envelopes of the same
+	// priority are sent oldest first.
+	TopicPriorities map[Topic]int
+
+	// BroadcastLimit caps the number of envelopes forwarded to each peer in a
+	// single transmission cycle (0 = DefaultBroadcastLimit). The cap is filled in
+	// priority order (see TopicPriorities), the remaining envelopes are deferred
+	// to later cycles.
+	BroadcastLimit int
+
+	// MaxSubscriptions caps the number of concurrently installed filters beyond
+	// which Subscribe refuses new ones (0 = DefaultMaxSubscriptions).
+	MaxSubscriptions int
+
+	// MaxHandlers caps the number of parallel handler invocations across all
+	// the concurrent filters of the node (0 = only the per filter limits apply).
+	// Default, serial handlers run on the dispatcher and are not counted.
+	MaxHandlers int
+
+	// EphemeralTopics lists the topics (e.g. presence or typing indicators) whose
+	// envelopes are relayed and delivered live, but never retained in the message
+	// store, thus never served by history queries either.
+	EphemeralTopics []Topic
+
+	// AuthorizeSubscribe, if set, is consulted by Subscribe with the topic
+	// conditions of each new filter before installing it, letting the host (e.g.
+	// a multi-tenant gateway) refuse unauthorized topics by returning an error.
+	AuthorizeSubscribe func(conditions [][]Topic) error
+
+	// Receipts, if set, receives an audit line for every message delivered to a
+	// filter, holding the delivery time, the envelope hash and the filter id. It
+	// is off by default, as every delivery incurs a write.
+	Receipts io.Writer
+
+	// TopicBudget caps the number of envelopes per second forwarded to each peer
+	// under any single first topic, so a noisy topic cannot consume all of the
+	// uplink (0 = unlimited). Envelopes over budget are held back and retried in
+	// later transmission cycles, while other topics are forwarded unhindered.
+	TopicBudget int
+}
+
+// Stats contains the runtime statistics of a whisper node.
+type Stats struct {
+	Matchers      int           // Number of currently installed topic matchers
+	MatcherTopics int           // Total number of topics across the installed matchers
+	MatcherBuild  time.Duration // Cumulative time spent building topic matchers
+	SelfDrops     int           // Number of self originated envelopes dropped when looped back
+	EmptySkips    int           // Number of empty payload (keepalive) deliveries suppressed by filters
+	TailDrops     int           // Number of envelopes dropped from lagging store tails
+	ReplayDrops   int           // Number of live messages dropped from overflowing replay backlogs
+}
+
 type MessageEvent struct {
 	To      *ecdsa.PrivateKey
 	From    *ecdsa.PublicKey
 	Message *Message
 }
 
+// SendResult is the outcome of sending a single message of a batch.
+type SendResult struct {
+	Hash common.Hash // Hash of the envelope the message was sent in (zero on failure)
+	Err  error       // Failure wrapping or sending the message (nil on success)
+}
+
 // Whisper represents a dark communication interface through the AiBlocks
 // network, using its very own P2P communication layer.
 type Whisper struct {
 	protocol p2p.Protocol
 	filters  *filter.Filters
 
-	keys map[string]*ecdsa.PrivateKey
+	keys  map[string]*ecdsa.PrivateKey
+	salt  []byte // Secret prepended to the data of all topics derived by the node
+	probe Topic  // Reserved (salted) topic of the latency probes
 
 	messages    map[common.Hash]*Envelope // Pool of messages currently tracked by this node
 	expirations map[uint32]*set.SetNonTS  // Message expiration pool (TODO: something lighter)
+	pinned      map[common.Hash]struct{}  // Envelopes exempted from expiration until unpinned
+	originated  map[common.Hash]uint32    // Expiry times of the envelopes sent by this node
 	poolMu      sync.RWMutex              // Mutex to sync the message and expiration pools
 
+	store Store                   // Message store retaining the envelopes for historical queries
+	tails map[*storeTail]struct{} // Live followers of the message store (guarded by poolMu)
+
+	ephemeral map[Topic]struct{} // Topics whose envelopes are never stored
+
+	priorities map[Topic]int // Transmission priorities of the envelope topics
+
 	peers  map[*peer]struct{} // Set of currently active peers
 	peerMu sync.RWMutex       // Mutex to sync the active peer set
 
+	maxSubscriptions int                              // Cap on the installed filters enforced by Subscribe
+	authorize        func(conditions [][]Topic) error // Host hook vetting the topics of new subscriptions
+	subscribeMu      sync.Mutex                       // Mutex to serialize the capped filter installations
+
+	handlers       chan struct{} // Node wide parallel handler slots (nil = unbounded)
+	topicBudget    int           // Envelopes per second forwarded to each peer per first topic (0 = unlimited)
+	broadcastLimit int           // Envelopes forwarded to each peer per transmission cycle
+
+	receipts   io.Writer  // Audit log of the deliveries (nil = disabled)
+	receiptsMu sync.Mutex // Mutex to serialize the receipt writes
+
+	matchers map[int]int // Topic counts of the installed matchers, keyed by filter id
+	stats    Stats       // Runtime statistics of the node
+	statsMu  sync.Mutex  // Mutex to sync the runtime statistics
+
+	clock *clock // Time source of the delivered messages' expiry signals
+
 	quit chan struct{}
 }
 
 // New creates a Whisper client ready to communicate through the AiBlocks P2P
 // network.
 func New() *Whisper {
+	return NewWithConfig(Config{})
+}
+
+// NewWithConfig creates a Whisper client ready to communicate through the
+// AiBlocks P2P network, using the specified optional settings.
+func NewWithConfig(config Config) *Whisper {
+	if config.Store == nil {
+		config.Store = newMemoryStore()
+	}
+	if config.MaxSubscriptions == 0 {
+		config.MaxSubscriptions = DefaultMaxSubscriptions
+	}
+	if config.BroadcastLimit == 0 {
+		config.BroadcastLimit = DefaultBroadcastLimit
+	}
 	whisper := &Whisper{
 		filters:     filter.New(),
 		keys:        make(map[string]*ecdsa.PrivateKey),
 		messages:    make(map[common.Hash]*Envelope),
+		pinned:      make(map[common.Hash]struct{}),
+		originated:  make(map[common.Hash]uint32),
 		expirations: make(map[uint32]*set.SetNonTS),
+		salt:        common.CopyBytes(config.TopicSalt),
+		probe:       newSaltedTopic(config.TopicSalt, probeTopicData),
+		store:       config.Store,
+		tails:       make(map[*storeTail]struct{}),
+		priorities:  config.TopicPriorities,
 		peers:       make(map[*peer]struct{}),
+		matchers:    make(map[int]int),
 		quit:        make(chan struct{}),
+		clock:       realClock,
+
+		maxSubscriptions: config.MaxSubscriptions,
+		authorize:        config.AuthorizeSubscribe,
+		receipts:         config.Receipts,
+		topicBudget:      config.TopicBudget,
+		broadcastLimit:   config.BroadcastLimit,
+	}
+	if config.MaxHandlers > 0 {
+		whisper.handlers = make(chan struct{}, config.MaxHandlers)
+	}
+	if len(config.EphemeralTopics) > 0 {
+		whisper.ephemeral = make(map[Topic]struct{}, len(config.EphemeralTopics))
+		for _, topic := range config.EphemeralTopics {
+			whisper.ephemeral[topic] = struct{}{}
+		}
 	}
 	whisper.filters.Start()
 
@@ -145,31 +324,419 @@ func (self *Whisper) GetIdentity(key *ecdsa.PublicKey) *ecdsa.PrivateKey {
 	return self.keys[string(crypto.FromECDSAPub(key))]
 }
 
+// NewTopic creates a topic from the data, mixing in the node's topic salt.
+func (self *Whisper) NewTopic(data []byte) Topic {
+	return newSaltedTopic(self.salt, data)
+}
+
+// NewTopics creates a list of topics from a list of binary data elements, mixing
+// in the node's topic salt.
+func (self *Whisper) NewTopics(data ...[]byte) []Topic {
+	return newSaltedTopics(self.salt, data...)
+}
+
+// NewFilterTopics creates a 2D topic array used by whisper.Filter from binary
+// data elements, mixing in the node's topic salt.
+func (self *Whisper) NewFilterTopics(data ...[][]byte) [][]Topic {
+	return newSaltedFilterTopics(self.salt, data...)
+}
+
+// NewFacetTopic creates a topic from a key=value facet, mixing in the node's topic
+// salt.
+func (self *Whisper) NewFacetTopic(key, value string) Topic {
+	return newSaltedFacetTopic(self.salt, key, value)
+}
+
+// NewFacetTopics creates the topic list of a message tagged with a set of facets,
+// mixing in the node's topic salt.
+func (self *Whisper) NewFacetTopics(facets map[string]string) []Topic {
+	return newSaltedFacetTopics(self.salt, facets)
+}
+
+// NewFacetFilterTopics creates a 2D topic array used by whisper.Filter from the
+// facet schema of the messages and their constraints, mixing in the node's topic
+// salt. Constraints on keys missing from the schema are rejected.
+func (self *Whisper) NewFacetFilterTopics(schema []string, constraints map[string]string) ([][]Topic, error) {
+	return newSaltedFacetFilterTopics(self.salt, schema, constraints)
+}
+
+// SubTopic derives a child topic of a parent one (see Topic.Sub), mixing in the
+// node's topic salt, so children stay unguessable even if the parent is seen.
+func (self *Whisper) SubTopic(parent Topic, child []byte) Topic {
+	return parent.saltedSub(self.salt, child)
+}
+
 // Watch installs a new message handler to run in case a matching packet arrives
 // from the whisper network.
 func (self *Whisper) Watch(options Filter) int {
+	fn := options.Fn
+
+	var receiptId int // Filter id to log the deliveries with, set once installed
+	if self.receipts != nil {
+		deliver := fn
+		fn = func(msg *Message) {
+			self.receipt(msg.Hash, &receiptId)
+			deliver(msg)
+		}
+	}
+	if options.SkipEmpty {
+		deliver := fn
+		fn = func(msg *Message) {
+			if len(msg.Payload) == 0 {
+				self.statsMu.Lock()
+				self.stats.EmptySkips++
+				self.statsMu.Unlock()
+				return
+			}
+			deliver(msg)
+		}
+	}
+	if options.Concurrency > 1 {
+		fn = concurrent(options.Concurrency, self.handlers, fn)
+	}
+	var replay *replayer
+	if !options.Since.IsZero() || !options.ResumeFrom.IsZero() {
+		replay = newReplayer(fn)
+		fn = replay.live
+	}
+	var senders map[string]struct{}
+	if len(options.Senders) > 0 {
+		senders = make(map[string]struct{}, len(options.Senders))
+		for _, sender := range options.Senders {
+			senders[string(crypto.FromECDSAPub(sender))] = struct{}{}
+		}
+	}
+	start := time.Now()
+	var matcher *topicMatcher
+	if len(options.Required) > 0 {
+		matcher = newUnorderedTopicMatcher(options.Required)
+	} else {
+		matcher = newTopicMatcher(options.Topics...)
+		matcher.treatMissingAsWildcard = options.Lenient
+		matcher.optionalSlots = options.Optional
+		matcher.exact = options.Exact
+	}
+	build := time.Since(start)
+
 	filter := filterer{
 		to:      string(crypto.FromECDSAPub(options.To)),
 		from:    string(crypto.FromECDSAPub(options.From)),
-		matcher: newTopicMatcher(options.Topics...),
+		senders: senders,
+		matcher: matcher,
+		pow:     options.MinPoW,
 		fn: func(data interface{}) {
-			options.Fn(data.(*Message))
+			fn(data.(*Message))
 		},
 	}
-	return self.filters.Install(filter)
+	if self.receipts != nil {
+		// Prevent deliveries from logging receipts until the filter id is known
+		self.receiptsMu.Lock()
+	}
+	id := self.filters.Install(filter)
+	if self.receipts != nil {
+		receiptId = id
+		self.receiptsMu.Unlock()
+	}
+
+	// Account the matcher in the runtime statistics
+	topics := len(matcher.required)
+	for _, condition := range matcher.conditions {
+		topics += len(condition)
+	}
+	self.statsMu.Lock()
+	self.matchers[id] = topics
+	self.stats.Matchers++
+	self.stats.MatcherTopics += topics
+	self.stats.MatcherBuild += build
+	self.statsMu.Unlock()
+
+	// Replay the matching stored history if requested, now that live messages are
+	// already being captured
+	if replay != nil {
+		history := self.history(filter, options.Since, options.ResumeFrom)
+		go func() {
+			replay.replay(history)
+			if dropped := replay.pending.Dropped(); dropped > 0 {
+				glog.V(logger.Debug).Infof("replay backlog of filter %d overflowed, dropped %d live message(s)", id, dropped)
+
+				self.statsMu.Lock()
+				self.stats.ReplayDrops += int(dropped)
+				self.statsMu.Unlock()
+			}
+		}()
+	}
+	return id
+}
+
+// receipt writes a delivery audit line into the receipt log. The filter id is
+// passed by reference, as it is only known once the filter is installed.
+func (self *Whisper) receipt(hash common.Hash, id *int) {
+	self.receiptsMu.Lock()
+	defer self.receiptsMu.Unlock()
+
+	if _, err := fmt.Fprintf(self.receipts, "%s %x %d\n", time.Now().UTC().Format(time.RFC3339Nano), hash, *id); err != nil {
+		glog.V(logger.Debug).Infof("failed to write delivery receipt for %x: %v", hash, err)
+	}
+}
+
+// history retrieves all the messages from the local message store that match a
+// filter and were sent after the given time and checkpoint, in checkpoint order.
+func (self *Whisper) history(filter filterer, since time.Time, cursor StoreCursor) []*Message {
+	envelopes, _ := storePage(self.store, self.store.Get(nil, since, time.Time{}), 0, cursor)
+
+	var messages []*Message
+	for _, envelope := range envelopes {
+		if message := self.open(envelope); message != nil && filter.Compare(createFilter(message, envelope.Topics)) {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// Subscribe installs a new message handler like Watch, but refuses to do so if
+// the node already has the maximum allowed number of handlers installed, or if
+// the configured authorization hook rejects its topics, returning the hook's
+// error. It is meant as the entry point for untrusted clients.
+func (self *Whisper) Subscribe(options Filter) (int, error) {
+	if self.authorize != nil {
+		if err := self.authorize(options.Topics); err != nil {
+			return 0, err
+		}
+	}
+	self.subscribeMu.Lock()
+	defer self.subscribeMu.Unlock()
+
+	self.statsMu.Lock()
+	installed := self.stats.Matchers
+	self.statsMu.Unlock()
+
+	if installed >= self.maxSubscriptions {
+		return 0, ErrTooManySubscriptions
+	}
+	return self.Watch(options), nil
 }
 
 // Unwatch removes an installed message handler.
 func (self *Whisper) Unwatch(id int) {
 	self.filters.Uninstall(id)
+
+	self.statsMu.Lock()
+	if topics, ok := self.matchers[id]; ok {
+		delete(self.matchers, id)
+		self.stats.Matchers--
+		self.stats.MatcherTopics -= topics
+	}
+	self.statsMu.Unlock()
+}
+
+// CloseAllSubscriptions removes every installed message handler, e.g. during
+// application teardown. Messages dispatched after it returns are not delivered,
+// but it does not wait for the ones already being dispatched: the dispatcher may
+// have matched a handler just before its removal, and may still invoke it with
+// that message afterwards.
+func (self *Whisper) CloseAllSubscriptions() {
+	self.statsMu.Lock()
+	ids := make([]int, 0, len(self.matchers))
+	for id := range self.matchers {
+		ids = append(ids, id)
+	}
+	self.statsMu.Unlock()
+
+	for _, id := range ids {
+		self.Unwatch(id)
+	}
+}
+
+// Narrow tightens the topic conditions of an installed filter, atomically
+// swapping in the new matcher: every message is matched against either the old
+// or the new conditions, so none matching the latter is lost during the swap.
+// The new conditions must only accept topic lists the old ones already did.
+func (self *Whisper) Narrow(id int, topics [][]Topic) error {
+	return self.retopic(id, topics, true)
+}
+
+// retopic atomically swaps the topic conditions of an installed filter, retaining
+// its other settings. If narrow is set, the new conditions must be subsumed by
+// the old ones. Unordered filters have no positional conditions to swap, so
+// they are refused.
+func (self *Whisper) retopic(id int, topics [][]Topic, narrow bool) error {
+	installed, ok := self.filters.Get(id).(filterer)
+	if !ok {
+		return ErrUnknownFilter
+	}
+	if installed.matcher.required != nil {
+		return ErrUnorderedFilter
+	}
+	matcher := newTopicMatcher(topics...)
+	matcher.treatMissingAsWildcard = installed.matcher.treatMissingAsWildcard
+	matcher.optionalSlots = installed.matcher.optionalSlots
+	matcher.exact = installed.matcher.exact
+	if narrow && !installed.matcher.Subsumes(matcher) {
+		return ErrNotNarrower
+	}
+	updated := installed
+	updated.matcher = matcher
+	if !self.filters.Replace(id, updated) {
+		return ErrUnknownFilter
+	}
+	// Account the new matcher in the runtime statistics
+	count := 0
+	for _, condition := range matcher.conditions {
+		count += len(condition)
+	}
+	self.statsMu.Lock()
+	if previous, ok := self.matchers[id]; ok {
+		self.matchers[id] = count
+		self.stats.MatcherTopics += count - previous
+	}
+	self.statsMu.Unlock()
+
+	return nil
 }
 
 // Send injects a message into the whisper send queue, to be distributed in the
 // network in the coming cycles.
 func (self *Whisper) Send(envelope *Envelope) error {
+	self.poolMu.Lock()
+	self.originated[envelope.Hash()] = envelope.Expiry
+	self.poolMu.Unlock()
+
 	return self.add(envelope)
 }
 
+// SendBatch wraps each of the messages with the given proof of work and options,
+// and injects the resulting envelopes into the send queue. The results are in
+// the same order as the messages, a failing message not affecting the others.
+func (self *Whisper) SendBatch(pow time.Duration, messages []*Message, options Options) []SendResult {
+	results := make([]SendResult, len(messages))
+	for i, message := range messages {
+		envelope, err := message.Wrap(pow, options)
+		if err == nil {
+			err = self.Send(envelope)
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Hash = envelope.Hash()
+	}
+	return results
+}
+
+// Reply sends an anonymous broadcast response to a previously received message,
+// published on the reply topic requested by the original sender.
+func (self *Whisper) Reply(to *Message, payload []byte) error {
+	return self.reply(to, payload, DefaultPoW)
+}
+
+// reply sends an anonymous broadcast response to a previously received message,
+// sealed with the requested proof of work.
+func (self *Whisper) reply(to *Message, payload []byte, pow time.Duration) error {
+	if to.ReplyTo.IsZero() {
+		return ErrNoReplyTopic
+	}
+	envelope, err := NewMessage(payload).Wrap(pow, Options{
+		Topics: []Topic{to.ReplyTo},
+	})
+	if err != nil {
+		return err
+	}
+	return self.Send(envelope)
+}
+
+// Call sends an anonymous broadcast request on the given topics, asking for the
+// response on a freshly generated reply topic, and waits for the first message
+// arriving on it. The temporary reply subscription is torn down before returning,
+// whether a response arrived or the context was cancelled first.
+func (self *Whisper) Call(ctx context.Context, topics []Topic, payload []byte) (*Message, error) {
+	return self.call(ctx, NewMessage(payload), DefaultPoW, Options{Topics: topics})
+}
+
+// ProbeLatency measures the round trip time to a remote node by sending it a
+// probe encrypted to one of its identities on a reserved topic, and waiting for
+// the acknowledgement it automatically replies with. Probes and their replies
+// are sealed without proof of work to keep it out of the measurement, but the
+// result still includes the transmission cycles of all the hops.
+func (self *Whisper) ProbeLatency(ctx context.Context, peer *ecdsa.PublicKey) (time.Duration, error) {
+	start := time.Now()
+	if _, err := self.call(ctx, NewMessage([]byte("probe")), 0, Options{To: peer, Topics: []Topic{self.probe}}); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// call sends a request wrapped with the given proof of work and options, asking
+// for the response on a freshly generated reply topic, and waits for the first
+// message arriving on it or the context being cancelled.
+func (self *Whisper) call(ctx context.Context, request *Message, pow time.Duration, options Options) (*Message, error) {
+	// Generate a random reply topic and watch for responses on it
+	var reply Topic
+	for reply.IsZero() {
+		if _, err := rand.Read(reply[:]); err != nil {
+			return nil, err
+		}
+	}
+	replies := make(chan *Message, 1)
+	id := self.Watch(Filter{
+		Topics: [][]Topic{{reply}},
+		Fn: func(msg *Message) {
+			select {
+			case replies <- msg:
+			default:
+			}
+		},
+	})
+	defer self.Unwatch(id)
+
+	// Send the request and wait for the response or cancellation
+	request.ReplyTo = reply
+
+	envelope, err := request.Wrap(pow, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.Send(envelope); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-replies:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Pin exempts an envelope from expiration, keeping it in the local pool and
+// forwarding it to newly connected peers for as long as the node runs or until
+// it's unpinned. The envelope may be pinned before it arrives. Note, remote nodes
+// still drop envelopes past their TTL on arrival, so pinning extends the local
+// retention only, not the lifetime of the envelope within the network.
+func (self *Whisper) Pin(hash common.Hash) error {
+	self.poolMu.Lock()
+	defer self.poolMu.Unlock()
+
+	if _, ok := self.pinned[hash]; ok {
+		return nil
+	}
+	if len(self.pinned) >= maxPinnedEnvelopes {
+		return ErrTooManyPins
+	}
+	self.pinned[hash] = struct{}{}
+	return nil
+}
+
+// Unpin removes the expiration exemption of an envelope, dropping it from the
+// pool right away if its TTL already elapsed.
+func (self *Whisper) Unpin(hash common.Hash) {
+	self.poolMu.Lock()
+	defer self.poolMu.Unlock()
+
+	delete(self.pinned, hash)
+	if envelope, ok := self.messages[hash]; ok && envelope.Expiry < uint32(time.Now().Unix()) {
+		delete(self.messages, hash)
+	}
+}
+
 // Start implements node.Service, starting the background data propagation thread
 // of the Whisper protocol.
 func (self *Whisper) Start(*p2p.Server) error {
@@ -201,6 +768,178 @@ func (self *Whisper) Messages(id int) []*Message {
 	return messages
 }
 
+// Stats retrieves the current runtime statistics of the node.
+func (self *Whisper) Stats() Stats {
+	self.statsMu.Lock()
+	defer self.statsMu.Unlock()
+
+	return self.stats
+}
+
+// QueryStore retrieves all the envelopes from the message store tagged with any
+// of the specified topics (or all if none given), sent within the [from, to]
+// interval. Zero times leave the corresponding side of the interval unbounded.
+func (self *Whisper) QueryStore(topics []Topic, from, to time.Time) []*Envelope {
+	return self.store.Get(topics, from, to)
+}
+
+// QueryStorePage is the paginated variant of QueryStore, retrieving at most limit
+// of the matching envelopes in local arrival order, starting right after the
+// cursor (the zero cursor starts from the earliest). The returned cursor continues
+// the query with the next page, and is zero once all matches have been served.
+//
+// Envelopes stored between pages arrive after the cursor, so later pages pick
+// them up regardless of their (sender claimed) send time, while the expired ones
+// are skipped without disturbing the rest.
+func (self *Whisper) QueryStorePage(topics []Topic, from, to time.Time, limit int, cursor StoreCursor) ([]*Envelope, StoreCursor) {
+	return storePage(self.store, self.store.Get(topics, from, to), limit, cursor)
+}
+
+// TailStore follows the message store, streaming the newly stored envelopes that
+// are tagged with any of the specified topics (or all if none given). The stream
+// is buffered, and once a lagging consumer lets the buffer fill up, the oldest
+// envelopes are dropped from it to make room (counted in Stats.TailDrops). The
+// returned function cancels the tail, closing the stream.
+func (self *Whisper) TailStore(topics []Topic) (<-chan *Envelope, func()) {
+	tail := &storeTail{
+		topics: topics,
+		buffer: common.NewBoundedBuffer(storeTailBuffer, common.DropOldest),
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	stream := make(chan *Envelope)
+	go tail.loop(stream)
+
+	self.poolMu.Lock()
+	self.tails[tail] = struct{}{}
+	self.poolMu.Unlock()
+
+	var once sync.Once
+	return stream, func() {
+		once.Do(func() {
+			self.poolMu.Lock()
+			delete(self.tails, tail)
+			self.poolMu.Unlock()
+
+			close(tail.quit)
+		})
+	}
+}
+
+// tail pushes a newly stored envelope to all the matching store followers. The
+// pool lock is assumed to be held.
+func (self *Whisper) tail(envelope *Envelope) {
+	for tail := range self.tails {
+		if !storeMatches(envelope, tail.topics, time.Time{}, time.Time{}) {
+			continue
+		}
+		dropped := tail.buffer.Dropped()
+		tail.buffer.Push(envelope)
+		if tail.buffer.Dropped() > dropped {
+			glog.V(logger.Debug).Infof("store tail lagging, dropped oldest envelope for %x", envelope.Hash())
+
+			self.statsMu.Lock()
+			self.stats.TailDrops++
+			self.statsMu.Unlock()
+		}
+		select {
+		case tail.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// storeTail is a live follower of the message store, buffering the envelopes
+// not yet consumed from its stream.
+type storeTail struct {
+	topics []Topic               // Topics the followed envelopes need any of (all if empty)
+	buffer *common.BoundedBuffer // Envelopes pending delivery, oldest dropped once full
+	wake   chan struct{}         // Signals envelopes pushed into an empty buffer
+	quit   chan struct{}         // Closed when the tail is cancelled
+}
+
+// loop feeds the buffered envelopes into the stream as the consumer reads them,
+// closing the stream once the tail is cancelled.
+func (self *storeTail) loop(stream chan *Envelope) {
+	defer close(stream)
+
+	for {
+		for item, ok := self.buffer.Pop(); ok; item, ok = self.buffer.Pop() {
+			select {
+			case stream <- item.(*Envelope):
+			case <-self.quit:
+				return
+			}
+		}
+		select {
+		case <-self.wake:
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+// StoreStats retrieves the per topic retention statistics of the envelopes
+// currently held in the message store.
+func (self *Whisper) StoreStats() map[Topic]StoreTopicStat {
+	return self.store.Stats()
+}
+
+// EstimateSubscriptionBandwidth estimates the incoming bandwidth in bytes per
+// second that a subscription with the given topic conditions would have matched,
+// based on the encoded sizes of the stored envelopes sent within the last window.
+// Ephemeral envelopes are never stored, so they are counted from the message
+// pool instead, covering only those not yet expired. The estimate only covers
+// the topic conditions, not any recipient or sender restrictions, and is as
+// accurate as the retention of that window.
+func (self *Whisper) EstimateSubscriptionBandwidth(conditions [][]Topic, window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	matcher := newTopicMatcher(conditions...)
+	from := time.Now().Add(-window)
+
+	var size int
+	envelopes := self.store.Get(nil, from, time.Time{})
+	for _, envelope := range self.ephemeralEnvelopes() {
+		if !time.Unix(int64(envelope.Expiry-envelope.TTL), 0).Before(from) {
+			envelopes = append(envelopes, envelope)
+		}
+	}
+	for _, envelope := range envelopes {
+		if matcher.Matches(envelope.Topics) {
+			enc, _ := rlp.EncodeToBytes(envelope)
+			size += len(enc)
+		}
+	}
+	return float64(size) / window.Seconds()
+}
+
+// TopicHistogram retrieves the at most limit most frequent topics of the message
+// store (all if limit is not positive), ordered by descending envelope count, as
+// a one-shot report for capacity planning. Ephemeral envelopes, never stored,
+// are counted from the message pool while they are not yet expired.
+func (self *Whisper) TopicHistogram(limit int) []TopicCount {
+	stats := make(map[Topic]StoreTopicStat)
+	for topic, stat := range self.store.Stats() {
+		stats[topic] = stat
+	}
+	for _, envelope := range self.ephemeralEnvelopes() {
+		seen := make(map[Topic]struct{}, len(envelope.Topics))
+		for _, topic := range envelope.Topics {
+			if _, ok := seen[topic]; ok {
+				continue
+			}
+			seen[topic] = struct{}{}
+
+			stat := stats[topic]
+			stat.add(envelope)
+			stats[topic] = stat
+		}
+	}
+	return topicHistogram(stats, limit)
+}
+
 // handlePeer is called by the underlying P2P layer when the whisper sub-protocol
 // connection is negotiated.
 func (self *Whisper) handlePeer(peer *p2p.Peer, rw p2p.MsgReadWriter) error {
@@ -236,8 +975,25 @@ func (self *Whisper) handlePeer(peer *p2p.Peer, rw p2p.MsgReadWriter) error {
 			glog.V(logger.Info).Infof("%v: failed to decode envelope: %v", peer, err)
 			continue
 		}
-		// Inject all envelopes into the internal pool
+		// Inject all envelopes into the internal pool, dropping our own looped back
+		// and malformed ones. The relaying peer is not punished for the latter, as
+		// it need not have created them (e.g. older nodes forward them unchecked).
 		for _, envelope := range envelopes {
+			if err := envelope.validate(); err != nil {
+				glog.V(logger.Debug).Infof("%v: dropping malformed envelope %x: %v", peer, envelope.Hash(), err)
+				whisperPeer.mark(envelope)
+				continue
+			}
+			if self.originatedBy(envelope) {
+				glog.V(logger.Detail).Infof("%v: dropping self originated envelope %x", peer, envelope.Hash())
+
+				self.statsMu.Lock()
+				self.stats.SelfDrops++
+				self.statsMu.Unlock()
+
+				whisperPeer.mark(envelope)
+				continue
+			}
 			if err := self.add(envelope); err != nil {
 				// TODO Punish peer here. Invalid envelope.
 				glog.V(logger.Debug).Infof("%v: failed to pool envelope: %v", peer, err)
@@ -267,6 +1023,14 @@ func (self *Whisper) add(envelope *Envelope) error {
 	}
 	self.messages[hash] = envelope
 
+	// Retain the message in the message store for historical queries
+	if self.isEphemeral(envelope) {
+		glog.V(logger.Detail).Infof("not storing ephemeral whisper envelope %x", hash)
+	} else if err := self.store.Put(envelope); err != nil {
+		glog.V(logger.Debug).Infof("failed to store whisper envelope %x: %v", hash, err)
+	} else {
+		self.tail(envelope)
+	}
 	// Insert the message into the expiration pool for later removal
 	if self.expirations[envelope.Expiry] == nil {
 		self.expirations[envelope.Expiry] = set.NewNonTS()
@@ -281,18 +1045,48 @@ func (self *Whisper) add(envelope *Envelope) error {
 	return nil
 }
 
+// originatedBy checks whether an envelope was sent by the local node.
+func (self *Whisper) originatedBy(envelope *Envelope) bool {
+	self.poolMu.RLock()
+	defer self.poolMu.RUnlock()
+
+	_, ok := self.originated[envelope.Hash()]
+	return ok
+}
+
 // postEvent opens an envelope with the configured identities and delivers the
 // message upstream from application processing.
 func (self *Whisper) postEvent(envelope *Envelope) {
-	if message := self.open(envelope); message != nil {
-		self.filters.Notify(createFilter(message, envelope.Topics), message)
+	message := self.open(envelope)
+	if message == nil {
+		return
+	}
+	// Acknowledge latency probes addressed to us instead of delivering them
+	if message.To != nil && len(envelope.Topics) > 0 && envelope.Topics[0] == self.probe {
+		if err := self.reply(message, nil, 0); err != nil {
+			glog.V(logger.Debug).Infof("failed to acknowledge latency probe %x: %v", message.Hash, err)
+		}
+		return
 	}
+	self.filters.Notify(createFilter(message, envelope.Topics), message)
 }
 
 // open tries to decrypt a whisper envelope with all the configured identities,
-// returning the decrypted message and the key used to achieve it. If not keys
-// are configured, open will return the payload as if non encrypted.
+// returning the decrypted message checkpointed at its position in the message
+// store (if retained there).
 func (self *Whisper) open(envelope *Envelope) *Message {
+	message := self.openWithIdentities(envelope)
+	if message != nil {
+		message.cursor = StoreCursor{Seq: self.store.Seq(envelope.Hash())}
+		message.expiry = newMessageExpiry(self.clock)
+	}
+	return message
+}
+
+// openWithIdentities tries to decrypt a whisper envelope with all the configured
+// identities, returning the decrypted message and the key used to achieve it. If
+// not keys are configured, it will return the payload as if non encrypted.
+func (self *Whisper) openWithIdentities(envelope *Envelope) *Message {
 	// Short circuit if no identity is set, and assume clear-text
 	if len(self.keys) == 0 {
 		if message, err := envelope.Open(nil); err == nil {
@@ -323,6 +1117,7 @@ func createFilter(message *Message, topics []Topic) filter.Filter {
 		to:      string(crypto.FromECDSAPub(message.To)),
 		from:    string(crypto.FromECDSAPub(message.Recover())),
 		matcher: newTopicMatcher(matcher...),
+		pow:     message.PoW,
 	}
 }
 
@@ -350,15 +1145,24 @@ func (self *Whisper) expire() {
 	self.poolMu.Lock()
 	defer self.poolMu.Unlock()
 
+	self.store.Prune(time.Now())
+
 	now := uint32(time.Now().Unix())
+	for hash, expiry := range self.originated {
+		if expiry < now {
+			delete(self.originated, hash)
+		}
+	}
 	for then, hashSet := range self.expirations {
 		// Short circuit if a future time
 		if then > now {
 			continue
 		}
-		// Dump all expired messages and remove timestamp
+		// Dump all expired (non pinned) messages and remove timestamp
 		hashSet.Each(func(v interface{}) bool {
-			delete(self.messages, v.(common.Hash))
+			if _, ok := self.pinned[v.(common.Hash)]; !ok {
+				delete(self.messages, v.(common.Hash))
+			}
 			return true
 		})
 		self.expirations[then].Clear()
@@ -376,3 +1180,75 @@ func (self *Whisper) envelopes() []*Envelope {
 	}
 	return envelopes
 }
+
+// isEphemeral checks whether an envelope is tagged with any ephemeral topic, and
+// must thus not be retained in the message store.
+func (self *Whisper) isEphemeral(envelope *Envelope) bool {
+	for _, topic := range envelope.Topics {
+		if _, ok := self.ephemeral[topic]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ephemeralEnvelopes retrieves the ephemeral envelopes currently tracked in the
+// message pool, which are the only record of them, as they are never stored.
+func (self *Whisper) ephemeralEnvelopes() []*Envelope {
+	if len(self.ephemeral) == 0 {
+		return nil
+	}
+	self.poolMu.RLock()
+	defer self.poolMu.RUnlock()
+
+	var envelopes []*Envelope
+	for _, envelope := range self.messages {
+		if self.isEphemeral(envelope) {
+			envelopes = append(envelopes, envelope)
+		}
+	}
+	return envelopes
+}
+
+// priority retrieves the transmission priority of an envelope, which is the
+// highest priority of its topics, or zero if none of them are prioritized.
+func (self *Whisper) priority(envelope *Envelope) int {
+	priority, found := 0, false
+	for _, topic := range envelope.Topics {
+		if p, ok := self.priorities[topic]; ok && (!found || p > priority) {
+			priority, found = p, true
+		}
+	}
+	return priority
+}
+
+// prioritize sorts a batch of envelopes into transmission order: by descending
+// topic priority first, and by ascending send time within the same priority.
+func (self *Whisper) prioritize(envelopes []*Envelope) {
+	priorities := make([]int, len(envelopes))
+	for i, envelope := range envelopes {
+		priorities[i] = self.priority(envelope)
+	}
+	sort.Sort(&envelopesByPriority{envelopes: envelopes, priorities: priorities})
+}
+
+// envelopesByPriority implements sort.Interface, ordering envelopes for
+// transmission.
+type envelopesByPriority struct {
+	envelopes  []*Envelope
+	priorities []int
+}
+
+func (self *envelopesByPriority) Len() int { return len(self.envelopes) }
+
+func (self *envelopesByPriority) Less(i, j int) bool {
+	if self.priorities[i] != self.priorities[j] {
+		return self.priorities[i] > self.priorities[j]
+	}
+	return self.envelopes[i].Expiry-self.envelopes[i].TTL < self.envelopes[j].Expiry-self.envelopes[j].TTL
+}
+
+func (self *envelopesByPriority) Swap(i, j int) {
+	self.envelopes[i], self.envelopes[j] = self.envelopes[j], self.envelopes[i]
+	self.priorities[i], self.priorities[j] = self.priorities[j], self.priorities[i]
+}
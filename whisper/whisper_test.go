@@ -19,9 +19,15 @@
 package whisper
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aiblocksproject/go-aiblocks/common"
+	"github.com/aiblocksproject/go-aiblocks/crypto"
 	"github.com/aiblocksproject/go-aiblocks/p2p"
 	"github.com/aiblocksproject/go-aiblocks/p2p/discover"
 )
@@ -47,6 +53,59 @@ func startTestCluster(n int) []*Whisper {
 	return whispers
 }
 
+// startTestLine creates a batch of whisper nodes wired into a line topology,
+// each node connected only to its immediate neighbours.
+func startTestLine(n int) []*Whisper {
+	whispers := make([]*Whisper, n)
+	for i := 0; i < n; i++ {
+		whispers[i] = New()
+		whispers[i].Start(nil)
+	}
+	for i := 1; i < n; i++ {
+		src, dst := p2p.MsgPipe()
+
+		go whispers[i-1].handlePeer(p2p.NewPeer(discover.NodeID{}, "", nil), src)
+		go whispers[i].handlePeer(p2p.NewPeer(discover.NodeID{}, "", nil), dst)
+	}
+	return whispers
+}
+
+func TestLinePropagation(t *testing.T) {
+	// Start a three node line, and watch for arrivals on the far end
+	line := startTestLine(3)
+
+	done := make(chan struct{})
+	line[2].Watch(Filter{
+		Topics: newFilterTopicsFromStringsFlat("line topic"),
+		Fn: func(msg *Message) {
+			close(done)
+		},
+	})
+	// Send a message from the first node, which must be relayed by the middle one
+	envelope, err := NewMessage([]byte("line whisper")).Wrap(DefaultPoW, Options{
+		Topics: newTopicsFromStrings("line topic"),
+		TTL:    DefaultTTL,
+	})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if err := line[0].Send(envelope); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(4 * transmissionCycle):
+		t.Fatalf("line message receive timeout")
+	}
+	// Ensure the middle node pooled the relayed envelope too
+	line[1].poolMu.RLock()
+	_, ok := line[1].messages[envelope.Hash()]
+	line[1].poolMu.RUnlock()
+	if !ok {
+		t.Fatalf("relayed envelope missing from middle node")
+	}
+}
+
 func TestSelfMessage(t *testing.T) {
 	// Start the single node cluster
 	client := startTestCluster(1)[0]
@@ -176,6 +235,581 @@ func testBroadcast(anonymous bool, t *testing.T) {
 	}
 }
 
+func TestReply(t *testing.T) {
+	// Start the single node cluster
+	node := startTestCluster(1)[0]
+
+	request := NewTopic([]byte("request topic"))
+	response := NewTopic([]byte("response topic"))
+
+	// Answer all requests, and watch for the answers on the reply topic
+	node.Watch(Filter{
+		Topics: [][]Topic{{request}},
+		Fn: func(msg *Message) {
+			if err := node.Reply(msg, []byte("pong")); err != nil {
+				t.Errorf("failed to reply: %v", err)
+			}
+		},
+	})
+	replies := make(chan *Message, 1)
+	node.Watch(Filter{
+		Topics: [][]Topic{{response}},
+		Fn: func(msg *Message) {
+			replies <- msg
+		},
+	})
+	// Send a request asking for a reply on the response topic
+	msg := NewMessage([]byte("ping"))
+	msg.ReplyTo = response
+
+	envelope, err := msg.Wrap(DefaultPoW, Options{Topics: []Topic{request}})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if err := node.Send(envelope); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	select {
+	case reply := <-replies:
+		if string(reply.Payload) != "pong" {
+			t.Fatalf("reply payload mismatch: have %q, want %q", reply.Payload, "pong")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("reply receive timeout")
+	}
+	// Ensure replying to a message without reply topic fails
+	if err := node.Reply(NewMessage(nil), []byte("pong")); err != ErrNoReplyTopic {
+		t.Fatalf("reply error mismatch: have %v, want %v", err, ErrNoReplyTopic)
+	}
+}
+
+func TestMatcherStats(t *testing.T) {
+	node := New()
+
+	// Install a few matchers and check the gauges
+	small := node.Watch(Filter{
+		Topics: newFilterTopicsFromStrings([]string{"a"}),
+		Fn:     func(*Message) {},
+	})
+	large := node.Watch(Filter{
+		Topics: newFilterTopicsFromStrings([]string{"a", "b", "c"}, []string{}, []string{"d", "e"}),
+		Fn:     func(*Message) {},
+	})
+	if stats := node.Stats(); stats.Matchers != 2 || stats.MatcherTopics != 6 {
+		t.Fatalf("installed stats mismatch: have %d matchers/%d topics, want %d/%d", stats.Matchers, stats.MatcherTopics, 2, 6)
+	}
+	build := node.Stats().MatcherBuild
+
+	// Uninstall them (and an unknown one) and check the gauges decrement
+	node.Unwatch(large)
+	if stats := node.Stats(); stats.Matchers != 1 || stats.MatcherTopics != 1 {
+		t.Fatalf("partial stats mismatch: have %d matchers/%d topics, want %d/%d", stats.Matchers, stats.MatcherTopics, 1, 1)
+	}
+	node.Unwatch(small)
+	node.Unwatch(small + large + 1)
+	if stats := node.Stats(); stats.Matchers != 0 || stats.MatcherTopics != 0 {
+		t.Fatalf("final stats mismatch: have %d matchers/%d topics, want %d/%d", stats.Matchers, stats.MatcherTopics, 0, 0)
+	}
+	if stats := node.Stats(); stats.MatcherBuild != build {
+		t.Fatalf("cumulative build time changed on uninstall: have %v, want %v", stats.MatcherBuild, build)
+	}
+}
+
+func TestFilterMinPoW(t *testing.T) {
+	node := New()
+
+	// Install a relaxed and a demanding subscription on the same topic
+	topics := newTopicsFromStrings("premium")
+	envelope, err := NewMessage([]byte("low effort")).Wrap(0, Options{Topics: topics})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	relaxed, demanding := make(chan *Message, 1), make(chan *Message, 1)
+	node.Watch(Filter{
+		Topics: [][]Topic{topics},
+		Fn:     func(msg *Message) { relaxed <- msg },
+	})
+	node.Watch(Filter{
+		Topics: [][]Topic{topics},
+		Fn:     func(msg *Message) { demanding <- msg },
+		MinPoW: envelope.PoW() + 1,
+	})
+	if err := node.Send(envelope); err != nil {
+		t.Fatalf("failed to send envelope: %v", err)
+	}
+	// Ensure the envelope is pooled for relay and delivered only where allowed
+	select {
+	case msg := <-relaxed:
+		if msg.PoW != envelope.PoW() {
+			t.Fatalf("message proof of work mismatch: have %v, want %v", msg.PoW, envelope.PoW())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered to relaxed subscription")
+	}
+	select {
+	case <-demanding:
+		t.Fatalf("low proof of work message delivered to demanding subscription")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if pooled := node.envelopes(); len(pooled) != 1 || pooled[0] != envelope {
+		t.Fatalf("relay pool mismatch: have %v, want %v", pooled, []*Envelope{envelope})
+	}
+}
+
+func TestTopicSalt(t *testing.T) {
+	sender := NewWithConfig(Config{TopicSalt: []byte("overlay")})
+	peer := NewWithConfig(Config{TopicSalt: []byte("overlay")})
+	outsider := NewWithConfig(Config{TopicSalt: []byte("outsider")})
+
+	if sender.NewTopic([]byte("topic")) == NewTopic([]byte("topic")) {
+		t.Fatalf("salted topic matches unsalted one")
+	}
+	// Subscribe on both receivers using their own topic derivations
+	delivered := map[*Whisper]chan *Message{peer: make(chan *Message, 1), outsider: make(chan *Message, 1)}
+	for node, ch := range delivered {
+		ch := ch
+		node.Watch(Filter{
+			Topics: node.NewFilterTopics([][]byte{[]byte("topic")}),
+			Fn:     func(msg *Message) { ch <- msg },
+		})
+	}
+	// Deliver a message tagged with the sender's derivation to both of them
+	envelope, err := NewMessage([]byte("private")).Wrap(DefaultPoW, Options{Topics: sender.NewTopics([]byte("topic"))})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	for node := range delivered {
+		if err := node.Send(envelope); err != nil {
+			t.Fatalf("failed to inject envelope: %v", err)
+		}
+	}
+	select {
+	case <-delivered[peer]:
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered to same salt node")
+	}
+	select {
+	case <-delivered[outsider]:
+		t.Fatalf("message delivered to differing salt node")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Ensure the derived topics (facets, children, probes) are salted consistently
+	parent, facets := NewTopic([]byte("parent")), map[string]string{"room": "lobby", "kind": "chat"}
+	if sender.NewFacetTopic("room", "lobby") != peer.NewFacetTopic("room", "lobby") || sender.NewFacetTopic("room", "lobby") == NewFacetTopic("room", "lobby") {
+		t.Fatalf("facet topic not salted consistently")
+	}
+	peerFacets, err := peer.NewFacetFilterTopics([]string{"kind", "room"}, map[string]string{"room": "lobby"})
+	if err != nil {
+		t.Fatalf("failed to create salted facet filter: %v", err)
+	}
+	if !newTopicMatcher(peerFacets...).Matches(sender.NewFacetTopics(facets)) {
+		t.Fatalf("salted facet filter doesn't match same salt facets")
+	}
+	outsiderFacets, err := outsider.NewFacetFilterTopics([]string{"kind", "room"}, map[string]string{"room": "lobby"})
+	if err != nil {
+		t.Fatalf("failed to create outsider facet filter: %v", err)
+	}
+	if newTopicMatcher(outsiderFacets...).Matches(sender.NewFacetTopics(facets)) {
+		t.Fatalf("salted facet filter matches differing salt facets")
+	}
+	if sender.SubTopic(parent, []byte("child")) != peer.SubTopic(parent, []byte("child")) || sender.SubTopic(parent, []byte("child")) == parent.Sub([]byte("child")) {
+		t.Fatalf("child topic not salted consistently")
+	}
+	if sender.probe != peer.probe || sender.probe == outsider.probe {
+		t.Fatalf("probe topic not salted consistently")
+	}
+	// Ensure unsalted nodes derive the same topics as the package constructors
+	plain := New()
+	if plain.NewFacetTopic("room", "lobby") != NewFacetTopic("room", "lobby") || plain.SubTopic(parent, []byte("child")) != parent.Sub([]byte("child")) {
+		t.Fatalf("unsalted node derivations mismatch package constructors")
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	node := New()
+
+	// Assemble a batch with an unwrappable message in the middle
+	invalid := NewMessage([]byte("invalid"))
+	invalid.Type = strings.Repeat("x", maxTypeLength+1)
+
+	messages := []*Message{NewMessage([]byte("first")), invalid, NewMessage([]byte("third"))}
+	results := node.SendBatch(DefaultPoW, messages, Options{Topics: newTopicsFromStrings("batch")})
+	if len(results) != len(messages) {
+		t.Fatalf("result count mismatch: have %d, want %d", len(results), len(messages))
+	}
+	for i, result := range results {
+		if i == 1 {
+			if result.Err == nil || result.Hash != (common.Hash{}) {
+				t.Errorf("result %d: failure mismatch: have hash %x, error %v", i, result.Hash, result.Err)
+			}
+			continue
+		}
+		if result.Err != nil || result.Hash == (common.Hash{}) {
+			t.Errorf("result %d: success mismatch: have hash %x, error %v", i, result.Hash, result.Err)
+		}
+	}
+	// Ensure the successful hashes identify the pooled envelopes
+	pooled := make(map[common.Hash]struct{})
+	for _, envelope := range node.envelopes() {
+		pooled[envelope.Hash()] = struct{}{}
+	}
+	if len(pooled) != 2 {
+		t.Fatalf("pooled envelope count mismatch: have %d, want %d", len(pooled), 2)
+	}
+	for _, i := range []int{0, 2} {
+		if _, ok := pooled[results[i].Hash]; !ok {
+			t.Errorf("result %d: hash %x not pooled", i, results[i].Hash)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	node := New()
+
+	// Install a responder echoing back requests on a dedicated topic
+	echo := newTopicsFromStrings("echo")
+	node.Watch(Filter{
+		Topics: [][]Topic{echo},
+		Fn: func(msg *Message) {
+			if err := node.Reply(msg, append([]byte("re: "), msg.Payload...)); err != nil {
+				t.Errorf("failed to reply: %v", err)
+			}
+		},
+	})
+	// Issue a call to the responder and check the response
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := node.Call(ctx, echo, []byte("ping"))
+	if err != nil {
+		t.Fatalf("failed to call responder: %v", err)
+	}
+	if string(reply.Payload) != "re: ping" {
+		t.Fatalf("reply payload mismatch: have %q, want %q", reply.Payload, "re: ping")
+	}
+	// Issue a call nobody answers and check it times out
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := node.Call(ctx, newTopicsFromStrings("void"), []byte("ping")); err != context.DeadlineExceeded {
+		t.Fatalf("unanswered call error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Ensure the temporary reply subscriptions were torn down
+	if stats := node.Stats(); stats.Matchers != 1 {
+		t.Fatalf("installed matcher count mismatch: have %d, want %d", stats.Matchers, 1)
+	}
+}
+
+func TestPinnedExpiration(t *testing.T) {
+	node := New()
+
+	// Inject a pinned and an unpinned short lived message
+	var envelopes []*Envelope
+	for _, payload := range []string{"pinned", "unpinned"} {
+		envelope, err := NewMessage([]byte(payload)).Wrap(DefaultPoW, Options{TTL: time.Second})
+		if err != nil {
+			t.Fatalf("failed to wrap message: %v", err)
+		}
+		if err := node.Send(envelope); err != nil {
+			t.Fatalf("failed to inject message: %v", err)
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	pinned := envelopes[0]
+	if err := node.Pin(pinned.Hash()); err != nil {
+		t.Fatalf("failed to pin envelope: %v", err)
+	}
+	// Wait for the TTL to elapse, expire the pool and check that only the pinned remains
+	time.Sleep(2 * time.Second)
+	node.expire()
+
+	if pooled := node.envelopes(); len(pooled) != 1 || pooled[0] != pinned {
+		t.Fatalf("pooled envelopes mismatch: have %v, want %v", pooled, []*Envelope{pinned})
+	}
+
+	// Unpin the envelope and ensure it's dropped
+	node.Unpin(pinned.Hash())
+	if pooled := node.envelopes(); len(pooled) != 0 {
+		t.Fatalf("unpinned envelope retained: %v", pooled)
+	}
+	// Ensure the number of pins is bounded
+	for i := 0; i < maxPinnedEnvelopes; i++ {
+		if err := node.Pin(common.BytesToHash([]byte{byte(i)})); err != nil {
+			t.Fatalf("pin %d: failed to pin envelope: %v", i, err)
+		}
+	}
+	if err := node.Pin(pinned.Hash()); err != ErrTooManyPins {
+		t.Fatalf("pin limit error mismatch: have %v, want %v", err, ErrTooManyPins)
+	}
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	node := NewWithConfig(Config{MaxSubscriptions: 3})
+
+	// Fill up the subscription slots and ensure further ones are refused
+	var ids []int
+	for i := 0; i < 3; i++ {
+		id, err := node.Subscribe(Filter{Fn: func(*Message) {}})
+		if err != nil {
+			t.Fatalf("subscription %d: failed to subscribe: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := node.Subscribe(Filter{Fn: func(*Message) {}}); err != ErrTooManySubscriptions {
+		t.Fatalf("over limit error mismatch: have %v, want %v", err, ErrTooManySubscriptions)
+	}
+	// Release a slot and ensure it can be reused
+	node.Unwatch(ids[0])
+	if _, err := node.Subscribe(Filter{Fn: func(*Message) {}}); err != nil {
+		t.Fatalf("failed to subscribe into released slot: %v", err)
+	}
+}
+
+func TestSubscribeAuthorization(t *testing.T) {
+	// Create a node only permitting subscriptions to a tenant's own topic
+	errUnauthorized := errors.New("unauthorized")
+	allowed := newTopicFromString("tenant")
+
+	node := NewWithConfig(Config{
+		AuthorizeSubscribe: func(conditions [][]Topic) error {
+			for _, condition := range conditions {
+				if len(condition) == 0 {
+					return errUnauthorized // wild-cards would leak other tenants
+				}
+				for _, topic := range condition {
+					if topic != allowed {
+						return errUnauthorized
+					}
+				}
+			}
+			return nil
+		},
+	})
+	tests := []struct {
+		topics [][]Topic
+		err    error
+	}{
+		{topics: newFilterTopicsFromStringsFlat("tenant"), err: nil},
+		{topics: newFilterTopicsFromStringsFlat("other"), err: errUnauthorized},
+		{topics: newFilterTopicsFromStrings([]string{"tenant", "other"}), err: errUnauthorized},
+		{topics: newFilterTopicsFromStrings([]string{"tenant"}, nil), err: errUnauthorized},
+	}
+	for i, tt := range tests {
+		if _, err := node.Subscribe(Filter{Topics: tt.topics, Fn: func(*Message) {}}); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	if installed := node.Stats().Matchers; installed != 1 {
+		t.Fatalf("installed subscription count mismatch: have %d, want %d", installed, 1)
+	}
+}
+
+func TestCloseAllSubscriptions(t *testing.T) {
+	node := New()
+
+	delivered := make(chan *Message, 10)
+	for i := 0; i < 3; i++ {
+		if _, err := node.Subscribe(Filter{Fn: func(msg *Message) { delivered <- msg }}); err != nil {
+			t.Fatalf("subscription %d: failed to subscribe: %v", i, err)
+		}
+	}
+	node.CloseAllSubscriptions()
+	if installed := node.Stats().Matchers; installed != 0 {
+		t.Fatalf("installed subscription count mismatch: have %d, want %d", installed, 0)
+	}
+	// Send a message and ensure it's not delivered anywhere
+	if err := node.Send(newStoreTestEnvelope(0, "closed", "a")); err != nil {
+		t.Fatalf("failed to send envelope: %v", err)
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("message delivered after closing: %q", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCloseAllSubscriptionsInFlight(t *testing.T) {
+	node := New()
+
+	// Subscribe a handler blocking on its first delivery
+	entered, release := make(chan struct{}), make(chan struct{})
+	delivered := make(chan *Message, 10)
+	if _, err := node.Subscribe(Filter{Fn: func(msg *Message) {
+		delivered <- msg
+		if string(msg.Payload) == "inflight" {
+			close(entered)
+			<-release
+		}
+	}}); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	envelope, err := NewMessage([]byte("inflight")).Wrap(DefaultPoW, Options{})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if err := node.Send(envelope); err != nil {
+		t.Fatalf("failed to send envelope: %v", err)
+	}
+	<-entered
+
+	// Close the subscriptions mid-dispatch, and ensure it does not wait for it
+	closed := make(chan struct{})
+	go func() {
+		node.CloseAllSubscriptions()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("closing blocked on the in-flight dispatch")
+	}
+	// Send a later message, release the handler and ensure only the first arrived
+	envelope, err = NewMessage([]byte("later")).Wrap(DefaultPoW, Options{})
+	if err != nil {
+		t.Fatalf("failed to wrap message: %v", err)
+	}
+	if err := node.Send(envelope); err != nil {
+		t.Fatalf("failed to send envelope: %v", err)
+	}
+	close(release)
+
+	if msg := <-delivered; string(msg.Payload) != "inflight" {
+		t.Fatalf("in-flight payload mismatch: have %q, want %q", msg.Payload, "inflight")
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("later message delivered after closing: %q", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProbeLatency(t *testing.T) {
+	nodes := startTestCluster(2)
+	identity := nodes[1].NewIdentity()
+
+	// Probe the remote node over the loopback pipe
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	latency, err := nodes[0].ProbeLatency(ctx, &identity.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to probe latency: %v", err)
+	}
+	if latency <= 0 || latency > time.Since(start) {
+		t.Fatalf("latency out of bounds: have %v, want (0, %v]", latency, time.Since(start))
+	}
+	// Probe an unknown identity and ensure it times out
+	stranger, _ := crypto.GenerateKey()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := nodes[0].ProbeLatency(ctx, &stranger.PublicKey); err != context.DeadlineExceeded {
+		t.Fatalf("unknown identity probe error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	node := New()
+
+	// Store a few envelopes (bypassing live delivery), one stale, one on a different topic
+	stale := newStoreTestEnvelope(-30*time.Second, "stale", "replay")
+	history := []*Envelope{
+		newStoreTestEnvelope(-10*time.Second, "first", "replay"),
+		newStoreTestEnvelope(-5*time.Second, "second", "replay"),
+	}
+	other := newStoreTestEnvelope(-5*time.Second, "other", "other")
+	for _, envelope := range append([]*Envelope{stale, other}, history...) {
+		if err := node.store.Put(envelope); err != nil {
+			t.Fatalf("failed to store envelope: %v", err)
+		}
+	}
+	// Subscribe with a warm-up replay, and resend a replayed envelope during it
+	delivered := make(chan *Message, 10)
+	if _, err := node.Subscribe(Filter{
+		Topics: [][]Topic{newTopicsFromStrings("replay")},
+		Fn:     func(msg *Message) { delivered <- msg },
+		Since:  time.Now().Add(-20 * time.Second),
+	}); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	go node.postEvent(history[0])
+
+	// Send a live message and ensure history, then live arrives, each once
+	live := newStoreTestEnvelope(0, "live", "replay")
+	if err := node.Send(live); err != nil {
+		t.Fatalf("failed to send live envelope: %v", err)
+	}
+	for i, want := range []string{"first", "second", "live"} {
+		select {
+		case msg := <-delivered:
+			if string(msg.Payload) != want {
+				t.Fatalf("message %d: payload mismatch: have %q, want %q", i, msg.Payload, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d: delivery timeout", i)
+		}
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("unexpected extra delivery: %q", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscribeResume(t *testing.T) {
+	store := newMemoryStore()
+
+	// Store a batch of envelopes, some sharing the same send second
+	for i := 0; i < 6; i++ {
+		envelope := newStoreTestEnvelope(-time.Duration(10-i/2)*time.Second, fmt.Sprintf("%d", i), "resume")
+		if err := store.Put(envelope); err != nil {
+			t.Fatalf("failed to store envelope: %v", err)
+		}
+	}
+	// Consume up to count messages through a node, checkpointing after each one
+	consume := func(node *Whisper, filter Filter, count int) ([]string, StoreCursor) {
+		delivered := make(chan *Message, 10)
+		filter.Topics = [][]Topic{newTopicsFromStrings("resume")}
+		filter.Fn = func(msg *Message) { delivered <- msg }
+
+		id := node.Watch(filter)
+		defer node.Unwatch(id)
+
+		var (
+			payloads   []string
+			checkpoint StoreCursor
+		)
+		for i := 0; i < count; i++ {
+			select {
+			case msg := <-delivered:
+				payloads = append(payloads, string(msg.Payload))
+				checkpoint = msg.Cursor()
+			case <-time.After(100 * time.Millisecond):
+				return payloads, checkpoint
+			}
+		}
+		return payloads, checkpoint
+	}
+	first, checkpoint := consume(NewWithConfig(Config{Store: store}), Filter{Since: time.Now().Add(-time.Minute)}, 3)
+
+	// Resume on a restarted node backed by the same store
+	second, _ := consume(NewWithConfig(Config{Store: store}), Filter{ResumeFrom: checkpoint}, 4)
+
+	// Ensure the two runs together yielded the full history exactly once
+	seen := make(map[string]bool)
+	for _, payload := range append(first, second...) {
+		if seen[payload] {
+			t.Fatalf("duplicate delivery of message %s", payload)
+		}
+		seen[payload] = true
+	}
+	if len(seen) != 6 {
+		t.Fatalf("delivered message count mismatch: have %d, want %d", len(seen), 6)
+	}
+}
+
 func TestMessageExpiration(t *testing.T) {
 	// Start the single node cluster and inject a dummy message
 	node := startTestCluster(1)[0]